@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	AlbumStatusPending = "pending"
+	// AlbumStatusFailed marks a customer or lead whose albums cannot be
+	// provisioned. Adding or editing a lead, or a restart, queues it again.
+	AlbumStatusFailed = "failed"
+
+	albumJobQueueSize = 1000
+)
+
+const (
+	albumJobQueued = iota + 1
+	albumJobRunning
+	// albumJobDirty is a running job asked for again, new pending leads may
+	// have arrived after it listed them.
+	albumJobDirty
+)
+
+// albumQueue provisions the albums of customers in the background. Jobs are
+// keyed by customer so a customer is never worked on by two workers at once.
+type albumQueue struct {
+	mu       sync.Mutex
+	jobs     chan string
+	state    map[string]int
+	attempts map[string]int
+	retry    retryPolicy
+	run      func(customerId string) error
+	fail     func(customerId string)
+}
+
+// newAlbumQueue returns a queue running jobs with run. A failed job is retried
+// with the capped backoff of retry until it succeeds, one failing with a
+// permanent error is handed to fail instead.
+func newAlbumQueue(retry retryPolicy, run func(customerId string) error, fail func(customerId string)) *albumQueue {
+	return &albumQueue{
+		jobs:     make(chan string, albumJobQueueSize),
+		state:    make(map[string]int),
+		attempts: make(map[string]int),
+		retry:    retry,
+		run:      run,
+		fail:     fail,
+	}
+}
+
+// start runs workers processing the queue.
+func (q *albumQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for customerId := range q.jobs {
+				q.process(customerId)
+			}
+		}()
+	}
+}
+
+// enqueue asks for the albums of a customer to be provisioned. A customer
+// that cannot be queued stays pending until the next resume.
+func (q *albumQueue) enqueue(customerId string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	switch q.state[customerId] {
+	case albumJobQueued, albumJobDirty:
+		return
+	case albumJobRunning:
+		q.state[customerId] = albumJobDirty
+		return
+	}
+
+	q.push(customerId)
+}
+
+// push sends a job while holding mu.
+func (q *albumQueue) push(customerId string) {
+	select {
+	case q.jobs <- customerId:
+		q.state[customerId] = albumJobQueued
+	default:
+		delete(q.state, customerId)
+		log.Println("album queue full, customer", customerId, "stays pending")
+	}
+}
+
+func (q *albumQueue) process(customerId string) {
+	q.mu.Lock()
+	q.state[customerId] = albumJobRunning
+	q.mu.Unlock()
+
+	err := q.run(customerId)
+	if giveUp := q.done(customerId, err); giveUp {
+		log.Println("album job", customerId, "failed", err)
+		q.fail(customerId)
+	}
+}
+
+// done records the outcome of a job and schedules what follows. It reports
+// whether the job is given up.
+func (q *albumQueue) done(customerId string, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dirty := q.state[customerId] == albumJobDirty
+	delete(q.state, customerId)
+
+	if err != nil {
+		if isPermanentJobError(err) {
+			delete(q.attempts, customerId)
+			return true
+		}
+
+		// The photo service may be down for long, the job waits for it.
+		q.attempts[customerId]++
+		attempt := q.attempts[customerId]
+
+		delay := q.retry.backoff(attempt)
+		log.Println("album job", customerId, "attempt", attempt, err, "retry in", delay)
+		time.AfterFunc(delay, func() {
+			q.enqueue(customerId)
+		})
+		return false
+	}
+
+	delete(q.attempts, customerId)
+	if dirty {
+		q.push(customerId)
+	}
+	return false
+}
+
+// permanentJobError marks a failure of a job retrying cannot fix.
+type permanentJobError struct {
+	error
+}
+
+func (e permanentJobError) Unwrap() error {
+	return e.error
+}
+
+// isPermanentJobError reports whether retrying a job cannot help: an album it
+// works in is gone, the photo service refused the request or the job itself
+// said so.
+func isPermanentJobError(err error) bool {
+	var permanent permanentJobError
+	return errors.Is(err, ErrAlbumNotFound) || isRejectedAlbumError(err) || errors.As(err, &permanent)
+}
+
+// needsAlbum reports whether the album job still has to provision a customer
+// or lead with the given album status.
+func needsAlbum(status string) bool {
+	return status == AlbumStatusPending || status == AlbumStatusFailed
+}
+
+// resumePendingAlbums queues the customers left pending or failed by a
+// previous run.
+func (s *CustomerHandlerImpl) resumePendingAlbums() {
+	query := Terms("album_status", AlbumStatusPending, AlbumStatusFailed)
+	err := s.eachCustomer(query, func(cus *entity.Customer) error {
+		s.albumQueue.enqueue(cus.ID)
+		return nil
+	})
+	if err != nil {
+		log.Println("resume pending albums", err)
+	}
+}
+
+// provisionAlbums creates the missing customer album, then the album of
+// every pending or failed lead with its photos moved in. Work done is saved as it goes
+// so a retry picks up where the failure happened.
+func (s *CustomerHandlerImpl) provisionAlbums(customerId string) error {
+	cus, err := s.repo.GetByID(customerId)
+	if err != nil {
+		return err
+	}
+
+	apiKey, err := s.apiRepo.GetBy("user_id", cus.UserID)
+	if err != nil {
+		return err
+	}
+
+	if len(cus.Album) == 0 {
+		albumId, albumPassword, err := s.createAlbum(apiKey.ID, s.albumName.customer(cus), cus.FullName, "")
+		if err != nil {
+			return err
+		}
+		err = s.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.Album = albumId
+			cus.AlbumPassword = albumPassword
+		})
+		if err != nil {
+			if err := s.albums.DeleteAlbum(apiKey.ID, albumId); err != nil {
+				log.Println("album job", customerId, err)
+			}
+			return err
+		}
+	}
+
+	leads, err := s.allLeads(cus.ID)
+	if err != nil {
+		return err
+	}
+	for _, lead := range leads {
+		if !needsAlbum(lead.AlbumStatus) {
+			continue
+		}
+		if err := s.provisionLead(apiKey.ID, cus, lead.ID); err != nil {
+			return err
+		}
+	}
+
+	if len(cus.AlbumStatus) > 0 {
+		return s.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.AlbumStatus = ""
+		})
+	}
+	return nil
+}
+
+// provisionLead gives a lead its album under the lead lock of the customer,
+// unless it was deleted or given one since the leads were listed.
+func (s *CustomerHandlerImpl) provisionLead(apiKey string, cus *entity.Customer, leadId string) error {
+	defer s.leadLocks.lock(cus.ID)()
+
+	lead, err := s.repo.GetLead(leadId)
+	if err != nil || lead.CID != cus.ID || !needsAlbum(lead.AlbumStatus) {
+		return nil
+	}
+	return s.provisionLeadAlbum(apiKey, cus, lead)
+}
+
+// failAlbums marks a customer whose albums were given up, and its pending
+// leads, failed.
+func (s *CustomerHandlerImpl) failAlbums(customerId string) {
+	leads, err := s.allLeads(customerId)
+	if err != nil {
+		log.Println("album job", customerId, "mark failed", err)
+		return
+	}
+	for _, lead := range leads {
+		if lead.AlbumStatus == AlbumStatusPending {
+			s.failLead(customerId, lead.ID)
+		}
+	}
+
+	cus, err := s.repo.GetByID(customerId)
+	if err == nil {
+		err = s.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.AlbumStatus = AlbumStatusFailed
+		})
+	}
+	if err != nil {
+		log.Println("album job", customerId, "mark failed", err)
+	}
+}
+
+// failLead marks a lead failed under the lead lock of its customer, unless
+// it got its album since the leads were listed.
+func (s *CustomerHandlerImpl) failLead(customerId, leadId string) {
+	defer s.leadLocks.lock(customerId)()
+
+	lead, err := s.repo.GetLead(leadId)
+	if err == nil && lead.AlbumStatus == AlbumStatusPending {
+		lead.AlbumStatus = AlbumStatusFailed
+		err = s.repo.AddLead([]*entity.CustomerLead{lead})
+	}
+	if err != nil {
+		log.Println("album job", customerId, leadId, "mark failed", err)
+	}
+}
+
+func (s *CustomerHandlerImpl) provisionLeadAlbum(apiKey string, cus *entity.Customer, lead *entity.CustomerLead) error {
+	var title string
+	if len(lead.BikipID) > 0 {
+		// The bikip was checked when the lead was stored, it has been
+		// removed since.
+		bikip, err := s.bikipRepo.Get(lead.BikipID)
+		if err != nil {
+			return permanentJobError{err}
+		}
+		title = bikip.Title
+	}
+
+	albumId, albumPassword, err := s.createAlbum(apiKey, s.albumName.lead(title, lead.RegAt), title, cus.Album)
+	if err != nil {
+		return err
+	}
+
+	var imgIds = make([]string, 0)
+	for _, img := range lead.Images {
+		imgIds = append(imgIds, img.GalleryID)
+	}
+	if len(imgIds) > 0 {
+		if err := s.albums.MoveImages(apiKey, imgIds, albumId); err != nil {
+			if err := s.albums.DeleteAlbum(apiKey, albumId); err != nil {
+				log.Println("album job", cus.ID, lead.ID, err)
+			}
+			return err
+		}
+	}
+
+	for _, img := range lead.Images {
+		img.Album = albumId
+		img.Category = "7" // Category customer
+	}
+	lead.AlbumPassword = albumPassword
+	lead.AlbumStatus = ""
+	lead.UpdatedAt = time.Now().Round(time.Second)
+
+	return s.repo.AddLead([]*entity.CustomerLead{lead})
+}
+
+var errAlbumPending = errors.New("album của khách hàng đang được tạo, vui lòng thử lại sau")
+
+// leadLocks serialises the writes of the leads of a customer between the
+// handlers and the album job, within this process. Whoever holds the lock
+// reads the lead again before changing it, so no stale copy is saved over
+// the work of the other.
+type leadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*leadLock
+}
+
+type leadLock struct {
+	sync.Mutex
+	users int
+}
+
+// lock locks the leads of a customer and returns the unlock function.
+func (l *leadLocks) lock(customerId string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*leadLock)
+	}
+	lock, ok := l.locks[customerId]
+	if !ok {
+		lock = &leadLock{}
+		l.locks[customerId] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, customerId)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+func TestAddRejectsUnknownBikip(t *testing.T) {
+	h := newTestHandler(t)
+
+	res := h.call(t, h.Add, agent("agent", "sales"), http.MethodPost, `{"full_name": "Nguyễn Văn An",
+		"leads": [{"bikip": {"id": "b1"}}, {"bikip": {"id": "nope"}}]}`)
+	if res.Status != http.StatusBadRequest || res.Message != "Không tìm thấy bikip với ID: nope" {
+		t.Fatalf("Add = %d %q, want the unknown bikip named", res.Status, res.Message)
+	}
+	if n := len(h.customers.customers); n != 0 {
+		t.Errorf("%d customers stored, want none", n)
+	}
+}
+
+func TestAlbumJobFailsOnMissingAlbum(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	if err := h.photos.DeleteAlbum("key-agent", cus.Album); err != nil {
+		t.Fatal(err)
+	}
+
+	res := h.call(t, h.Lead, agent("agent", "sales"), http.MethodPost, `[{"bikip_id": "b1"}]`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Lead = %d %s", res.Status, res.Message)
+	}
+
+	if got := h.waitAlbums(t, "c1"); got.AlbumStatus != AlbumStatusFailed {
+		t.Fatalf("album status = %q, want %q", got.AlbumStatus, AlbumStatusFailed)
+	}
+	for _, lead := range h.customers.customerLeads("c1") {
+		if lead.AlbumStatus != AlbumStatusFailed {
+			t.Errorf("lead album status = %q, want %q", lead.AlbumStatus, AlbumStatusFailed)
+		}
+	}
+	h.checkNoAttempts(t)
+}
+
+func TestAlbumJobGivesUp(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	cus.AlbumStatus = AlbumStatusPending
+	if err := h.saveCustomer(cus); err != nil {
+		t.Fatal(err)
+	}
+	// The bikip was removed after the lead was added.
+	lead := &entity.CustomerLead{ID: "l1", CID: "c1", BikipID: "gone", AlbumStatus: AlbumStatusPending}
+	if err := h.customers.AddLead([]*entity.CustomerLead{lead}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.albumQueue.enqueue("c1")
+	if got := h.waitAlbums(t, "c1"); got.AlbumStatus != AlbumStatusFailed {
+		t.Fatalf("album status = %q, want %q", got.AlbumStatus, AlbumStatusFailed)
+	}
+	h.checkNoAttempts(t)
+}
+
+func TestUpdateCustomerRetriesConflicts(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+
+	stale, _ := h.customers.GetByID("c1")
+	other, _ := h.customers.GetByID("c1")
+	other.Note = "saved by a user"
+	if err := h.saveCustomer(other); err != nil {
+		t.Fatal(err)
+	}
+
+	leadAt := time.Now().Round(time.Second)
+	err := h.updateCustomer(stale, func(cus *entity.Customer) {
+		cus.LeadAt = &leadAt
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := h.customers.GetByID("c1")
+	if stored.Note != "saved by a user" || stored.LeadAt == nil || stored.Version != 3 {
+		t.Errorf("customer = note %q, lead at %v, version %d; want both changes at version 3",
+			stored.Note, stored.LeadAt, stored.Version)
+	}
+}
+
+// checkNoAttempts fails if the queue still counts attempts for a job.
+func (h *testHandler) checkNoAttempts(t *testing.T) {
+	t.Helper()
+
+	h.albumQueue.mu.Lock()
+	defer h.albumQueue.mu.Unlock()
+
+	if n := len(h.albumQueue.attempts); n != 0 {
+		t.Errorf("queue keeps attempts for %d jobs", n)
+	}
+}
+
+// downAlbumService fails to create albums until the given number of calls
+// has been refused.
+type downAlbumService struct {
+	*MemoryAlbumService
+	down int32
+}
+
+func (d *downAlbumService) CreateAlbum(apiKey, name, desc, parent, password string) (string, error) {
+	if atomic.AddInt32(&d.down, -1) >= 0 {
+		return "", ErrCircuitOpen
+	}
+	return d.MemoryAlbumService.CreateAlbum(apiKey, name, desc, parent, password)
+}
+
+func TestAlbumJobWaitsForPhotoService(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+	h.albums = &downAlbumService{MemoryAlbumService: h.photos, down: 25}
+
+	res := h.call(t, h.Lead, agent("agent", "sales"), http.MethodPost, `[{"bikip_id": "b1", "images": [{"gallery_id": "img1"}]}]`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Lead = %d %s", res.Status, res.Message)
+	}
+
+	if got := h.waitAlbums(t, "c1"); got.AlbumStatus != "" {
+		t.Fatalf("album status = %q, want the albums provisioned", got.AlbumStatus)
+	}
+	lead := h.customers.customerLeads("c1")[0]
+	if lead.AlbumStatus != "" || h.photos.Album(leadAlbumOf(lead)) == nil {
+		t.Errorf("lead = %+v, want its album", lead)
+	}
+	h.checkNoAttempts(t)
+}
+
+func TestFailedLeadsAreRequeued(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	cus := h.seed(t, "c1", "agent", "sales")
+	cus.AlbumStatus = AlbumStatusFailed
+	if err := h.saveCustomer(cus); err != nil {
+		t.Fatal(err)
+	}
+	failed := []*entity.CustomerLead{
+		{ID: "l1", CID: "c1", BikipID: "b1", AlbumStatus: AlbumStatusFailed, Images: []*entity.Image{{GalleryID: "img1"}}},
+		{ID: "l2", CID: "c1", BikipID: "b2", AlbumStatus: AlbumStatusFailed, Images: []*entity.Image{{GalleryID: "img2"}}},
+	}
+	if err := h.customers.AddLead(failed); err != nil {
+		t.Fatal(err)
+	}
+
+	res := h.call(t, h.Lead, user, http.MethodPost, `[{"bikip_id": "b1", "images": [{"gallery_id": "img3"}]}]`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Lead = %d %s", res.Status, res.Message)
+	}
+	if got := h.waitAlbums(t, "c1"); got.AlbumStatus != "" {
+		t.Fatalf("album status = %q, want the albums provisioned", got.AlbumStatus)
+	}
+	for _, lead := range h.customers.customerLeads("c1") {
+		if lead.AlbumStatus != "" || h.photos.Album(leadAlbumOf(lead)) == nil {
+			t.Errorf("lead %s = %q, want its album", lead.ID, lead.AlbumStatus)
+		}
+	}
+}
+
+func TestUpdateLeadRequeuesFailedLead(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+	lead := &entity.CustomerLead{ID: "l1", CID: "c1", BikipID: "b1", AlbumStatus: AlbumStatusFailed,
+		Images: []*entity.Image{{GalleryID: "img1"}}}
+	if err := h.customers.AddLead([]*entity.CustomerLead{lead}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := h.call(t, h.UpdateLead, user, http.MethodPut, `{"bikip_id": "nope"}`, "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusBadRequest {
+		t.Fatalf("UpdateLead to an unknown bikip = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+
+	res = h.call(t, h.UpdateLead, user, http.MethodPut, `{"bikip_id": "b2"}`, "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UpdateLead = %d %s", res.Status, res.Message)
+	}
+	h.waitAlbums(t, "c1")
+
+	stored, _ := h.customers.GetLead("l1")
+	album := h.photos.Album(leadAlbumOf(stored))
+	if stored.AlbumStatus != "" || album == nil || album.Desc != "Nhà phố Quận 3 giá 9 tỷ" {
+		t.Errorf("lead = %q with album %+v, want an album after b2", stored.AlbumStatus, album)
+	}
+}
+
+func TestUpdateQueuesNewLeads(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.Update, user, http.MethodPut, `{"full_name": "Khách c1", "city": "HCM",
+		"leads": [{"bikip_id": "nope"}]}`, "id", "c1")
+	if res.Status != http.StatusBadRequest {
+		t.Fatalf("Update with an unknown bikip = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+	if cus, _ := h.customers.GetByID("c1"); cus.City != "" || cus.LeadCount != 0 {
+		t.Fatalf("customer = %+v, want it untouched", cus)
+	}
+
+	res = h.call(t, h.Update, user, http.MethodPut, `{"full_name": "Khách c1",
+		"leads": [{"bikip_id": "b1", "images": [{"gallery_id": "img1"}], "reg_at": "2024-05-01T10:00:00Z"}]}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Update = %d %s", res.Status, res.Message)
+	}
+	cus := h.waitAlbums(t, "c1")
+	if cus.AlbumStatus != "" || cus.LeadAt == nil || cus.LeadAt.Year() != 2024 {
+		t.Errorf("customer = status %q, lead at %v; want the lead recorded", cus.AlbumStatus, cus.LeadAt)
+	}
+	lead := h.customers.customerLeads("c1")[0]
+	if lead.AlbumStatus != "" || h.photos.Album(leadAlbumOf(lead)) == nil {
+		t.Errorf("lead = %+v, want its album", lead)
+	}
+}
+
+func TestUploadLeadImagesQueuesPendingLead(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+	lead := &entity.CustomerLead{ID: "l1", CID: "c1", BikipID: "b1", AlbumStatus: AlbumStatusFailed}
+	if err := h.customers.AddLead([]*entity.CustomerLead{lead}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := h.upload(t, h.UploadLeadImages, agent("agent", "sales"), "photo.jpg", jpeg(), "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UploadLeadImages = %d %s", res.Status, res.Message)
+	}
+
+	if cus := h.waitAlbums(t, "c1"); cus.AlbumStatus != "" {
+		t.Fatalf("album status = %q, want the albums provisioned", cus.AlbumStatus)
+	}
+	stored, _ := h.customers.GetLead("l1")
+	album := h.photos.Album(leadAlbumOf(stored))
+	if stored.AlbumStatus != "" || album == nil || len(album.Images) != 1 {
+		t.Errorf("lead = %q with album %+v, want the photo in its album", stored.AlbumStatus, album)
+	}
+}
+
+// A handler waiting for the lead lock works on the lead as the album job
+// left it, not on the copy it could have read before.
+func TestUpdateLeadWaitsForAlbumJob(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	lead := &entity.CustomerLead{ID: "l1", CID: "c1", BikipID: "b1", AlbumStatus: AlbumStatusPending,
+		Images: []*entity.Image{{GalleryID: "img1"}}}
+	if err := h.customers.AddLead([]*entity.CustomerLead{lead}); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := h.leadLocks.lock("c1")
+	done := make(chan testResponse)
+	go func() {
+		res, _ := h.do(h.UpdateLead, agent("agent", "sales"), http.MethodPut, `{"comment": "second visit"}`, "id", "c1", "leadId", "l1")
+		done <- res
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	stale, _ := h.customers.GetLead("l1")
+	if err := h.provisionLeadAlbum("key-agent", cus, stale); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	if res := <-done; res.Status != http.StatusOK {
+		t.Fatalf("UpdateLead = %d %s", res.Status, res.Message)
+	}
+	stored, _ := h.customers.GetLead("l1")
+	if stored.AlbumStatus != "" || h.photos.Album(leadAlbumOf(stored)) == nil || stored.Comment != "second visit" {
+		t.Errorf("lead = %+v, want the album of the job and the new comment", stored)
+	}
+}
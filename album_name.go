@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	DefaultCustomerAlbumTemplate = "KH - {customer.full_name}"
+	DefaultLeadAlbumTemplate     = "LEAD - {bikip.title}"
+
+	// maxAlbumTitleRunes bounds the customer name or bikip title put in an
+	// album name.
+	maxAlbumTitleRunes = 90
+)
+
+// priceUnit matches the first price unit of a bikip title ("... 5 tỷ",
+// "... 800 triệu"), everything after it is dropped from album names.
+var priceUnit = regexp.MustCompile(`(?i)(tỷ|triệu)`)
+
+// albumNamer names customer and lead albums from templates. Templates may use
+// {customer.full_name}, {bikip.title} and {reg_at}.
+type albumNamer struct {
+	customerTemplate string
+	leadTemplate     string
+}
+
+func newAlbumNamer(customerTemplate, leadTemplate string) *albumNamer {
+	if len(customerTemplate) == 0 {
+		customerTemplate = DefaultCustomerAlbumTemplate
+	}
+	if len(leadTemplate) == 0 {
+		leadTemplate = DefaultLeadAlbumTemplate
+	}
+	return &albumNamer{
+		customerTemplate: customerTemplate,
+		leadTemplate:     leadTemplate,
+	}
+}
+
+func (n *albumNamer) customer(cus *entity.Customer) string {
+	return strings.NewReplacer(
+		"{customer.full_name}", truncateRunes(cus.FullName, maxAlbumTitleRunes),
+	).Replace(n.customerTemplate)
+}
+
+func (n *albumNamer) lead(bikipTitle string, regAt time.Time) string {
+	var reg string
+	if !regAt.IsZero() {
+		reg = regAt.Format("02/01/2006")
+	}
+
+	return strings.NewReplacer(
+		"{bikip.title}", shortBikipTitle(bikipTitle),
+		"{reg_at}", reg,
+	).Replace(n.leadTemplate)
+}
+
+// prefixes returns the fixed start of customer and lead album names, the
+// part of the templates before the first placeholder.
+func (n *albumNamer) prefixes() []string {
+	prefixes := make([]string, 0, 2)
+	for _, template := range []string{n.customerTemplate, n.leadTemplate} {
+		if i := strings.Index(template, "{"); i > 0 {
+			prefixes = append(prefixes, template[:i])
+		}
+	}
+	return prefixes
+}
+
+// shortBikipTitle cuts a bikip title right after its price and keeps it
+// within maxAlbumTitleRunes.
+func shortBikipTitle(title string) string {
+	if loc := priceUnit.FindStringIndex(title); loc != nil {
+		title = title[:loc[1]]
+	}
+	// A cut may end on a space.
+	return strings.TrimSpace(truncateRunes(strings.TrimSpace(title), maxAlbumTitleRunes))
+}
+
+// truncateRunes keeps at most max characters of s without splitting a
+// multi-byte character.
+func truncateRunes(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+
+	count := 0
+	for i := range s {
+		if count == max {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	long := strings.Repeat("Nguyễn ", 20)
+
+	tests := []struct {
+		name string
+		in   string
+		max  int
+		want string
+	}{
+		{"short", "Nguyễn Văn An", 90, "Nguyễn Văn An"},
+		{"exact", "Trần", 4, "Trần"},
+		{"multi-byte", "Trần Thị Bình", 6, "Trần T"},
+		{"cut on a multi-byte rune", "Nguyễn", 5, "Nguyễ"},
+		{"90 runes", long, 90, string([]rune(long)[:90])},
+		{"empty", "", 90, ""},
+	}
+	for _, tt := range tests {
+		got := truncateRunes(tt.in, tt.max)
+		if got != tt.want {
+			t.Errorf("%s: truncateRunes = %q, want %q", tt.name, got, tt.want)
+		}
+		if !utf8.ValidString(got) || utf8.RuneCountInString(got) > tt.max {
+			t.Errorf("%s: %q is not %d valid runes at most", tt.name, got, tt.max)
+		}
+	}
+}
+
+func TestShortBikipTitle(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Căn hộ Quận 1 giá 5 tỷ, view sông", "Căn hộ Quận 1 giá 5 tỷ"},
+		{"Đất nền Bình Chánh 800 triệu sổ hồng riêng", "Đất nền Bình Chánh 800 triệu"},
+		{"Nhà phố 2 tỷ 500 triệu", "Nhà phố 2 tỷ"},
+		{"Nhà phố 9 TỶ thương lượng", "Nhà phố 9 TỶ"},
+		{"  Văn phòng cho thuê  ", "Văn phòng cho thuê"},
+		{strings.Repeat("Biệt thự ", 20), strings.TrimSpace(string([]rune(strings.Repeat("Biệt thự ", 20))[:90]))},
+	}
+	for _, tt := range tests {
+		if got := shortBikipTitle(tt.in); got != tt.want {
+			t.Errorf("shortBikipTitle(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateLeadRenamesOnRegAt(t *testing.T) {
+	h := newTestHandler(t)
+	h.albumName = newAlbumNamer("", "LEAD - {bikip.title} - {reg_at}")
+	cus := h.seed(t, "c1", "agent", "sales")
+	albumId := leadAlbumOf(h.seedLead(t, cus, "l1", "b1", "img1"))
+
+	res := h.call(t, h.UpdateLead, agent("agent", "sales"), http.MethodPut, `{"reg_at": "2024-05-01T10:00:00Z"}`, "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UpdateLead = %d %s", res.Status, res.Message)
+	}
+
+	want := h.albumName.lead("Căn hộ Quận 1 giá 5 tỷ", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	if album := h.photos.Album(albumId); album == nil || album.Name != want {
+		t.Errorf("lead album = %+v, want it renamed %q", album, want)
+	}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+// newAlbumPassword returns a random 16 hex digit album password.
+func newAlbumPassword() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// createAlbum creates a password protected album with a fresh password and
+// returns the album id with the password encrypted for storage.
+func (s *CustomerHandlerImpl) createAlbum(apiKey, name, desc, parent string) (string, string, error) {
+	password, err := newAlbumPassword()
+	if err != nil {
+		return "", "", err
+	}
+
+	albumId, err := s.albums.CreateAlbum(apiKey, name, desc, parent, password)
+	if err != nil {
+		return "", "", err
+	}
+
+	encrypted, err := s.cipher.Encrypt(password)
+	if err != nil {
+		return "", "", err
+	}
+	return albumId, encrypted, nil
+}
+
+// revealAlbumPasswords replaces the stored album passwords of a customer and
+// its leads by their plain text. Callers check the viewer may see the customer.
+func (s *CustomerHandlerImpl) revealAlbumPasswords(cus *entity.Customer) {
+	cus.AlbumPassword, _ = s.cipher.Decrypt(cus.AlbumPassword)
+	if cus.Lead == nil {
+		return
+	}
+	for _, lead := range cus.Lead.Items {
+		lead.AlbumPassword, _ = s.cipher.Decrypt(lead.AlbumPassword)
+	}
+}
+
+func hideAlbumPasswords(cus *entity.Customer) {
+	cus.AlbumPassword = ""
+	if cus.Lead == nil {
+		return
+	}
+	for _, lead := range cus.Lead.Items {
+		lead.AlbumPassword = ""
+	}
+}
+
+// RotateAlbumPasswords gives every customer and lead album a new password.
+// The rotation runs in the background, progress goes to the log.
+func (s *CustomerHandlerImpl) RotateAlbumPasswords(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	// Two rotations at once could store one password while the album
+	// ends up with the other.
+	if !atomic.CompareAndSwapInt32(&s.rotating, 0, 1) {
+		return c.JSON(http.StatusConflict, Response{
+			Code:    http.StatusConflict,
+			Message: "Đang đổi mật khẩu album, vui lòng thử lại sau",
+		})
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&s.rotating, 0)
+
+		rotated, err := s.rotateAlbumPasswords()
+		log.Println("rotate album passwords:", rotated, "albums", err)
+	}()
+
+	return c.JSON(http.StatusAccepted, Response{
+		Code:    http.StatusAccepted,
+		Message: "Success",
+	})
+}
+
+func (s *CustomerHandlerImpl) rotateAlbumPasswords() (int, error) {
+	rotated := 0
+	err := s.eachCustomer(And(), func(cus *entity.Customer) error {
+		n, err := s.rotateCustomerPasswords(cus)
+		rotated += n
+		if err != nil {
+			log.Println("rotate album passwords", cus.ID, err)
+		}
+		return nil
+	})
+	return rotated, err
+}
+
+// rotateCustomerPasswords gives the albums of a customer and its leads new
+// passwords. The new passwords are stored before the albums get them, and an
+// album whose update fails gets its previous password back, so the stored
+// password never lags behind the album.
+func (s *CustomerHandlerImpl) rotateCustomerPasswords(cus *entity.Customer) (int, error) {
+	apiKey, err := s.apiRepo.GetBy("user_id", cus.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	if len(cus.Album) > 0 {
+		password, encrypted, err := s.newSealedPassword()
+		if err != nil {
+			return rotated, err
+		}
+		previous := cus.AlbumPassword
+		err = s.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.AlbumPassword = encrypted
+		})
+		if err != nil {
+			return rotated, err
+		}
+		if albumErr := s.albums.SetAlbumPassword(apiKey.ID, cus.Album, password); albumErr != nil {
+			err := s.updateCustomer(cus, func(cus *entity.Customer) {
+				cus.AlbumPassword = previous
+			})
+			if err != nil {
+				log.Println("rotate album passwords", cus.ID, "restore password", err)
+			}
+			return rotated, albumErr
+		}
+		rotated++
+	}
+
+	leads, err := s.allLeads(cus.ID)
+	if err != nil {
+		return rotated, err
+	}
+
+	type rekey struct {
+		lead     *entity.CustomerLead
+		albumId  string
+		password string
+		previous string
+	}
+	rekeys := make([]*rekey, 0, len(leads))
+	changed := make([]*entity.CustomerLead, 0, len(leads))
+	for _, lead := range leads {
+		albumId := leadAlbumOf(lead)
+		if len(albumId) == 0 {
+			continue
+		}
+		password, encrypted, err := s.newSealedPassword()
+		if err != nil {
+			return rotated, err
+		}
+		rekeys = append(rekeys, &rekey{lead: lead, albumId: albumId, password: password, previous: lead.AlbumPassword})
+		lead.AlbumPassword = encrypted
+		changed = append(changed, lead)
+	}
+	if len(changed) == 0 {
+		return rotated, nil
+	}
+
+	if err := s.repo.AddLead(changed); err != nil {
+		return rotated, err
+	}
+
+	failed := make([]*entity.CustomerLead, 0)
+	for _, r := range rekeys {
+		if err := s.albums.SetAlbumPassword(apiKey.ID, r.albumId, r.password); err != nil {
+			log.Println("rotate album passwords", cus.ID, r.lead.ID, err)
+			r.lead.AlbumPassword = r.previous
+			failed = append(failed, r.lead)
+			continue
+		}
+		rotated++
+	}
+
+	if len(failed) > 0 {
+		if err := s.repo.AddLead(failed); err != nil {
+			return rotated, err
+		}
+	}
+	return rotated, nil
+}
+
+// newSealedPassword returns a new album password, plain and encrypted for
+// storage.
+func (s *CustomerHandlerImpl) newSealedPassword() (string, string, error) {
+	password, err := newAlbumPassword()
+	if err != nil {
+		return "", "", err
+	}
+	encrypted, err := s.cipher.Encrypt(password)
+	if err != nil {
+		return "", "", err
+	}
+	return password, encrypted, nil
+}
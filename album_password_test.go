@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// flakyAlbumService fails to set the password of the listed albums.
+type flakyAlbumService struct {
+	*MemoryAlbumService
+	fail map[string]bool
+}
+
+func (f *flakyAlbumService) SetAlbumPassword(apiKey, albumId, password string) error {
+	if f.fail[albumId] {
+		return errors.New("photo service timeout")
+	}
+	return f.MemoryAlbumService.SetAlbumPassword(apiKey, albumId, password)
+}
+
+func TestRotateCustomerPasswords(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	h.seedLead(t, cus, "l1", "b1", "img1")
+	failing := h.seedLead(t, cus, "l2", "b2", "img2")
+
+	h.albums = &flakyAlbumService{
+		MemoryAlbumService: h.photos,
+		fail:               map[string]bool{leadAlbumOf(failing): true},
+	}
+
+	rotated, err := h.rotateCustomerPasswords(cus)
+	if err != nil || rotated != 2 {
+		t.Fatalf("rotateCustomerPasswords = %d, %v, want 2 albums", rotated, err)
+	}
+
+	stored, _ := h.customers.GetByID("c1")
+	h.checkPassword(t, "customer", stored.AlbumPassword, stored.Album)
+	for _, id := range []string{"l1", "l2"} {
+		lead, _ := h.customers.GetLead(id)
+		h.checkPassword(t, id, lead.AlbumPassword, leadAlbumOf(lead))
+	}
+	if album := h.photos.Album(leadAlbumOf(failing)); album.Password != "secret" {
+		t.Errorf("failed album password = %q, want it unchanged", album.Password)
+	}
+}
+
+func TestRotateCustomerPasswordsRestores(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+
+	h.albums = &flakyAlbumService{
+		MemoryAlbumService: h.photos,
+		fail:               map[string]bool{cus.Album: true},
+	}
+
+	if _, err := h.rotateCustomerPasswords(cus); err == nil {
+		t.Fatal("want the album error")
+	}
+	stored, _ := h.customers.GetByID("c1")
+	h.checkPassword(t, "customer", stored.AlbumPassword, stored.Album)
+}
+
+// checkPassword fails unless a stored password opens the album.
+func (h *testHandler) checkPassword(t *testing.T, name, stored, albumId string) {
+	t.Helper()
+
+	plain, err := h.cipher.Decrypt(stored)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	if album := h.photos.Album(albumId); album == nil || album.Password != plain {
+		t.Errorf("%s: stored password %q does not open album %+v", name, plain, album)
+	}
+}
+
+func TestRotateAlbumPasswordsRunsOnce(t *testing.T) {
+	h := newTestHandler(t)
+	admin := agent("root", "hq", "admin.member.view")
+
+	h.rotating = 1
+	res := h.call(t, h.RotateAlbumPasswords, admin, http.MethodPost, "")
+	if res.Status != http.StatusConflict {
+		t.Errorf("RotateAlbumPasswords while running = %d, want %d", res.Status, http.StatusConflict)
+	}
+}
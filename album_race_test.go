@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gitlab.com/daitheky/api-portal-admin/repository"
+)
+
+// jitterAlbumService delays album creation and photo moves at random, so the
+// album worker interleaves with the handlers in many orders.
+type jitterAlbumService struct {
+	*MemoryAlbumService
+}
+
+func jitter() {
+	time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+}
+
+func (j *jitterAlbumService) CreateAlbum(apiKey, name, desc, parent, password string) (string, error) {
+	jitter()
+	return j.MemoryAlbumService.CreateAlbum(apiKey, name, desc, parent, password)
+}
+
+func (j *jitterAlbumService) MoveImages(apiKey string, imageIds []string, albumId string) error {
+	jitter()
+	return j.MemoryAlbumService.MoveImages(apiKey, imageIds, albumId)
+}
+
+// TestAddAndLeadConcurrently adds customers and leads from many goroutines
+// while the album worker provisions them. Run it with -race.
+func TestAddAndLeadConcurrently(t *testing.T) {
+	h := newTestHandler(t)
+	h.albums = &jitterAlbumService{MemoryAlbumService: h.photos}
+	addAndLeadConcurrently(t, h)
+}
+
+// TestAddAndLeadOverHTTP runs the same load through the HTTP client of the
+// photo service, shared by the handlers and the album workers.
+func TestAddAndLeadOverHTTP(t *testing.T) {
+	h := newTestHandler(t)
+	srv := httptest.NewServer(photoServer(h.photos))
+	defer srv.Close()
+	h.albums = newHTTPAlbumService(&repository.Config{AlbumAPI: srv.URL, PhotoAPI: srv.URL + "/photos"})
+	addAndLeadConcurrently(t, h)
+}
+
+// photoServer answers the album and photo endpoints used by the album job
+// from a MemoryAlbumService.
+func photoServer(photos *MemoryAlbumService) http.Handler {
+	answer := func(w http.ResponseWriter, res interface{}, err error) {
+		switch {
+		case errors.Is(err, ErrAlbumNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, errAlbumNotOwned):
+			w.WriteHeader(http.StatusForbidden)
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			json.NewEncoder(w).Encode(res)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/create-album", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		albumId, err := photos.CreateAlbum(r.PostForm.Get("key"), r.PostForm.Get("album[name]"),
+			r.PostForm.Get("album[description]"), r.PostForm.Get("album[parent_id]"), r.PostForm.Get("album[password]"))
+		answer(w, map[string]interface{}{"album": map[string]string{"id_encoded": albumId}}, err)
+	})
+	mux.HandleFunc("/photos/edit", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := photos.MoveImages(r.PostForm.Get("key"), r.PostForm["editing[ids][]"], r.PostForm.Get("editing[album_id]"))
+		answer(w, map[string]interface{}{}, err)
+	})
+	mux.HandleFunc("/delete-album", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		err := photos.DeleteAlbum(r.PostForm.Get("key"), r.PostForm.Get("album_id"))
+		answer(w, map[string]interface{}{}, err)
+	})
+	return mux
+}
+
+// addAndLeadConcurrently adds customers and leads from many goroutines, then
+// checks every customer and lead ended up with exactly one album.
+func addAndLeadConcurrently(t *testing.T, h *testHandler) {
+	const (
+		adders        = 4
+		addsPerAdder  = 3
+		leadWriters   = 3
+		leadsPerWrite = 4
+	)
+
+	user := agent("agent", "sales")
+
+	seeded := []string{"s1", "s2"}
+	for _, id := range seeded {
+		h.seed(t, id, "agent", "sales")
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed []string
+	)
+	report := func(what string, res testResponse, err error) {
+		if err == nil && res.Status == http.StatusOK {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		failed = append(failed, fmt.Sprintf("%s: %d %s %v", what, res.Status, res.Message, err))
+	}
+
+	for a := 0; a < adders; a++ {
+		wg.Add(1)
+		go func(a int) {
+			defer wg.Done()
+			for i := 0; i < addsPerAdder; i++ {
+				body := fmt.Sprintf(`{"full_name": "Customer %s", "leads": [
+					{"bikip": {"id": "b1"}, "images": [{"gallery_id": "add-%d-%d-1"}], "reg_at": "2024-05-01T10:00:00Z"},
+					{"bikip": {"id": "b2"}, "images": [{"gallery_id": "add-%d-%d-2"}], "reg_at": "2024-05-02T10:00:00Z"}]}`,
+					uuid.New().String(), a, i, a, i)
+				res, err := h.do(h.Add, user, http.MethodPost, body)
+				report("Add", res, err)
+			}
+		}(a)
+	}
+
+	for _, id := range seeded {
+		for w := 0; w < leadWriters; w++ {
+			wg.Add(1)
+			go func(id string, w int) {
+				defer wg.Done()
+				for i := 0; i < leadsPerWrite; i++ {
+					body := fmt.Sprintf(`[{"bikip_id": "b1", "images": [{"gallery_id": "lead-%s-%d-%d"}],
+						"reg_at": "2024-06-%02dT10:00:00Z"}]`, id, w, i, i+1)
+					res, err := h.do(h.Lead, user, http.MethodPost, body, "id", id)
+					report("Lead "+id, res, err)
+				}
+			}(id, w)
+		}
+	}
+
+	wg.Wait()
+	for _, f := range failed {
+		t.Error(f)
+	}
+
+	h.customers.mu.Lock()
+	ids := make([]string, 0, len(h.customers.customers))
+	for id := range h.customers.customers {
+		ids = append(ids, id)
+	}
+	h.customers.mu.Unlock()
+
+	if want := len(seeded) + adders*addsPerAdder; len(ids) != want {
+		t.Fatalf("%d customers, want %d", len(ids), want)
+	}
+
+	albums := 0
+	for _, id := range ids {
+		cus := h.waitAlbums(t, id)
+		if cus.AlbumStatus != "" || h.photos.Album(cus.Album) == nil {
+			t.Errorf("%s: album %q status %q", id, cus.Album, cus.AlbumStatus)
+			continue
+		}
+		albums++
+
+		leads := h.customers.customerLeads(id)
+		want := 2
+		if id == "s1" || id == "s2" {
+			want = leadWriters * leadsPerWrite
+		}
+		if len(leads) != want {
+			t.Errorf("%s: %d leads, want %d", id, len(leads), want)
+		}
+		for _, lead := range leads {
+			album := h.photos.Album(leadAlbumOf(lead))
+			if lead.AlbumStatus != "" || album == nil || album.Parent != cus.Album || len(album.Images) != len(lead.Images) {
+				t.Errorf("%s: lead %s status %q album %+v", id, lead.ID, lead.AlbumStatus, album)
+				continue
+			}
+			albums++
+		}
+	}
+
+	if n := h.photos.Len(); n != albums {
+		t.Errorf("%d albums on the photo service, want %d", n, albums)
+	}
+}
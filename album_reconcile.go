@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	AlbumIssueMissing  = "missing"
+	AlbumIssueMisnamed = "misnamed"
+	AlbumIssueOrphaned = "orphaned"
+	// AlbumIssueUnchecked is an album, or an account, the photo service
+	// could not be asked about.
+	AlbumIssueUnchecked = "unchecked"
+)
+
+// AlbumIssue is a mismatch between the customer records and the photo service.
+type AlbumIssue struct {
+	Kind       string `json:"kind"`
+	CustomerID string `json:"customer_id,omitempty"`
+	LeadID     string `json:"lead_id,omitempty"`
+	AlbumID    string `json:"album_id"`
+	Name       string `json:"name,omitempty"`
+	Expected   string `json:"expected,omitempty"`
+	Repaired   bool   `json:"repaired"`
+	Error      string `json:"error,omitempty"`
+}
+
+type AlbumReport struct {
+	Customers int           `json:"customers"`
+	Leads     int           `json:"leads"`
+	Albums    int           `json:"albums"`
+	Issues    []*AlbumIssue `json:"issues"`
+}
+
+// albumReconciler walks the customers of the repository and compares them
+// with the albums of their owners on the photo service.
+type albumReconciler struct {
+	s      *CustomerHandlerImpl
+	repair bool
+	report *AlbumReport
+	// known holds the albums referenced by records, per owner api key.
+	known map[string]map[string]bool
+	// requeue holds the customers whose albums have to be created again.
+	requeue map[string]bool
+}
+
+// Reconcile looks for the albums that are missing, orphaned or misnamed. With
+// repair=true missing albums are recreated, misnamed ones renamed and empty
+// orphans deleted. It runs in the background, the report goes to the log.
+func (s *CustomerHandlerImpl) Reconcile(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.reconciling, 0, 1) {
+		return c.JSON(http.StatusConflict, Response{
+			Code:    http.StatusConflict,
+			Message: "Đang đối soát album, vui lòng thử lại sau",
+		})
+	}
+
+	repair, _ := strconv.ParseBool(c.QueryParam("repair"))
+	go func() {
+		defer atomic.StoreInt32(&s.reconciling, 0)
+
+		report, err := s.reconcileAlbums(repair)
+		for _, issue := range report.Issues {
+			log.Println("reconcile albums:", issue.Kind, "customer", issue.CustomerID, "lead", issue.LeadID,
+				"album", issue.AlbumID, "repaired", issue.Repaired, issue.Error)
+		}
+		log.Println("reconcile albums:", report.Customers, "customers", report.Leads, "leads",
+			report.Albums, "albums", len(report.Issues), "issues", err)
+	}()
+
+	return c.JSON(http.StatusAccepted, Response{
+		Code:    http.StatusAccepted,
+		Message: "Success",
+	})
+}
+
+func (s *CustomerHandlerImpl) reconcileAlbums(repair bool) (*AlbumReport, error) {
+	r := &albumReconciler{
+		s:       s,
+		repair:  repair,
+		report:  &AlbumReport{Issues: make([]*AlbumIssue, 0)},
+		known:   make(map[string]map[string]bool),
+		requeue: make(map[string]bool),
+	}
+
+	// Trashed customers are walked too, their albums are kept for Restore.
+	if err := s.eachCustomer(And(), r.checkCustomer); err != nil {
+		return r.report, err
+	}
+
+	for apiKey, known := range r.known {
+		r.checkOrphans(apiKey, known)
+	}
+
+	for customerId := range r.requeue {
+		s.albumQueue.enqueue(customerId)
+	}
+	return r.report, nil
+}
+
+func (r *albumReconciler) checkCustomer(cus *entity.Customer) error {
+	if cus.DeletedAt != nil {
+		return r.keepAlbums(cus)
+	}
+	r.report.Customers++
+
+	// Without the owner's key nothing can be checked, the customer is
+	// reported and the run goes on.
+	apiKey, err := r.s.apiRepo.GetBy("user_id", cus.UserID)
+	if err != nil {
+		r.report.Issues = append(r.report.Issues, &AlbumIssue{
+			Kind:       AlbumIssueUnchecked,
+			CustomerID: cus.ID,
+			AlbumID:    cus.Album,
+			Error:      "get api key error: " + err.Error(),
+		})
+		return nil
+	}
+	known, ok := r.known[apiKey.ID]
+	if !ok {
+		known = make(map[string]bool)
+		r.known[apiKey.ID] = known
+	}
+
+	if len(cus.Album) > 0 {
+		known[cus.Album] = true
+		missing := r.checkAlbum(apiKey.ID, &AlbumIssue{
+			CustomerID: cus.ID,
+			AlbumID:    cus.Album,
+			Expected:   r.s.albumName.customer(cus),
+		})
+		if missing && r.repair {
+			err := r.s.updateCustomer(cus, func(cus *entity.Customer) {
+				cus.Album = ""
+				cus.AlbumPassword = ""
+				cus.AlbumStatus = AlbumStatusPending
+			})
+			if err != nil {
+				return err
+			}
+			r.requeue[cus.ID] = true
+		}
+	}
+
+	leads, err := r.s.allLeads(cus.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, lead := range leads {
+		r.report.Leads++
+		albumId := leadAlbumOf(lead)
+		if len(albumId) == 0 || lead.AlbumStatus == AlbumStatusPending {
+			continue
+		}
+		known[albumId] = true
+
+		// Without the bikip the expected name is unknown.
+		bikip, err := r.s.bikipRepo.Get(lead.BikipID)
+		if err != nil {
+			r.report.Issues = append(r.report.Issues, &AlbumIssue{
+				Kind:       AlbumIssueUnchecked,
+				CustomerID: cus.ID,
+				LeadID:     lead.ID,
+				AlbumID:    albumId,
+				Error:      "get bikip error: " + err.Error(),
+			})
+			continue
+		}
+		missing := r.checkAlbum(apiKey.ID, &AlbumIssue{
+			CustomerID: cus.ID,
+			LeadID:     lead.ID,
+			AlbumID:    albumId,
+			Expected:   r.s.albumName.lead(bikip.Title, lead.RegAt),
+		})
+		if missing && r.repair {
+			lead.AlbumStatus = AlbumStatusPending
+			lead.AlbumPassword = ""
+			if err := r.s.repo.AddLead([]*entity.CustomerLead{lead}); err != nil {
+				return err
+			}
+			r.requeue[cus.ID] = true
+		}
+	}
+
+	if r.requeue[cus.ID] && cus.AlbumStatus != AlbumStatusPending {
+		return r.s.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.AlbumStatus = AlbumStatusPending
+		})
+	}
+	return nil
+}
+
+// keepAlbums marks the albums of a trashed customer as known, so they are
+// not taken for orphans. They are neither checked nor repaired.
+func (r *albumReconciler) keepAlbums(cus *entity.Customer) error {
+	apiKey, err := r.s.apiRepo.GetBy("user_id", cus.UserID)
+	if err != nil {
+		return nil
+	}
+	known, ok := r.known[apiKey.ID]
+	if !ok {
+		known = make(map[string]bool)
+		r.known[apiKey.ID] = known
+	}
+	if len(cus.Album) > 0 {
+		known[cus.Album] = true
+	}
+
+	leads, err := r.s.allLeads(cus.ID)
+	if err != nil {
+		return err
+	}
+	for _, lead := range leads {
+		if albumId := leadAlbumOf(lead); len(albumId) > 0 {
+			known[albumId] = true
+		}
+	}
+	return nil
+}
+
+// checkAlbum reports whether the album of an issue is missing, and renames it
+// when repairing if it does not have the expected name. An album the photo
+// service cannot tell about is reported unchecked, not missing.
+func (r *albumReconciler) checkAlbum(apiKey string, issue *AlbumIssue) bool {
+	r.report.Albums++
+
+	album, err := r.s.albums.GetAlbum(apiKey, issue.AlbumID)
+	if errors.Is(err, ErrAlbumNotFound) {
+		issue.Kind = AlbumIssueMissing
+		issue.Repaired = r.repair
+		r.report.Issues = append(r.report.Issues, issue)
+		return true
+	}
+	if err != nil {
+		issue.Kind = AlbumIssueUnchecked
+		issue.Error = err.Error()
+		r.report.Issues = append(r.report.Issues, issue)
+		return false
+	}
+
+	if album.Name == issue.Expected {
+		return false
+	}
+
+	issue.Kind = AlbumIssueMisnamed
+	issue.Name = album.Name
+	if r.repair {
+		if err := r.s.albums.RenameAlbum(apiKey, album.ID, issue.Expected, album.Desc); err != nil {
+			issue.Error = err.Error()
+		} else {
+			issue.Repaired = true
+		}
+	}
+	r.report.Issues = append(r.report.Issues, issue)
+	return false
+}
+
+// checkOrphans reports the customer and lead albums of an account that no
+// record points to. Only empty orphans are deleted, photos are never lost.
+func (r *albumReconciler) checkOrphans(apiKey string, known map[string]bool) {
+	albums, err := r.s.albums.ListAlbums(apiKey)
+	if err != nil {
+		r.report.Issues = append(r.report.Issues, &AlbumIssue{
+			Kind:  AlbumIssueUnchecked,
+			Error: "list albums error: " + err.Error(),
+		})
+		return
+	}
+
+	for _, album := range albums {
+		if known[album.ID] {
+			continue
+		}
+		if !r.isCustomerAlbum(album.Name) {
+			continue
+		}
+
+		issue := &AlbumIssue{
+			Kind:    AlbumIssueOrphaned,
+			AlbumID: album.ID,
+			Name:    album.Name,
+		}
+		if r.repair && album.ImageCount == 0 {
+			if err := r.s.albums.DeleteAlbum(apiKey, album.ID); err != nil {
+				issue.Error = err.Error()
+			} else {
+				issue.Repaired = true
+			}
+		}
+		r.report.Issues = append(r.report.Issues, issue)
+	}
+}
+
+// isCustomerAlbum reports whether an album name follows the customer or lead
+// naming conventions, other albums of the account are left alone.
+func (r *albumReconciler) isCustomerAlbum(name string) bool {
+	for _, prefix := range r.s.albumName.prefixes() {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
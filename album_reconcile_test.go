@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReconcileAlbums(t *testing.T) {
+	h := newTestHandler(t)
+
+	misnamed := h.seed(t, "c1", "agent", "sales")
+
+	h.seed(t, "c2", "nokey", "sales")
+	h.apiKeys.missing["nokey"] = true
+
+	deleted := h.seed(t, "c3", "agent", "sales")
+	h.photos.DeleteAlbum("key-agent", deleted.Album)
+	now := time.Now()
+	deleted.DeletedAt = &now
+	h.saveCustomer(deleted)
+
+	transferred := h.seed(t, "c4", "agent", "sales")
+	h.photos.TransferAlbum("key-agent", transferred.Album, "key-agent2")
+
+	missing := h.seed(t, "c5", "agent", "sales")
+	h.photos.DeleteAlbum("key-agent", missing.Album)
+
+	report, err := h.reconcileAlbums(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := make(map[string]string)
+	for _, issue := range report.Issues {
+		if len(issue.CustomerID) > 0 {
+			kinds[issue.CustomerID] = issue.Kind
+		}
+	}
+	want := map[string]string{
+		"c1": AlbumIssueMisnamed,
+		"c2": AlbumIssueUnchecked,
+		"c4": AlbumIssueUnchecked,
+		"c5": AlbumIssueMissing,
+	}
+	for id, kind := range want {
+		if kinds[id] != kind {
+			t.Errorf("%s: issue %q, want %q", id, kinds[id], kind)
+		}
+	}
+	if kind, ok := kinds["c3"]; ok {
+		t.Errorf("deleted customer reported %q", kind)
+	}
+
+	album := h.photos.Album(misnamed.Album)
+	if album.Name != h.albumName.customer(misnamed) || album.Desc != "c1" {
+		t.Errorf("renamed album = %q %q, want the expected name and the description kept", album.Name, album.Desc)
+	}
+
+	if cus, _ := h.customers.GetByID("c4"); cus.Album != transferred.Album {
+		t.Error("album of another account recreated")
+	}
+	if cus := h.waitAlbums(t, "c5"); len(cus.Album) == 0 || cus.Album == missing.Album {
+		t.Errorf("missing album not recreated: %q", cus.Album)
+	}
+}
+
+func TestReconcileRunsOnce(t *testing.T) {
+	h := newTestHandler(t)
+	admin := agent("root", "hq", "admin.member.view")
+
+	h.reconciling = 1
+	res := h.call(t, h.Reconcile, admin, http.MethodPost, "")
+	if res.Status != http.StatusConflict {
+		t.Errorf("Reconcile while running = %d, want %d", res.Status, http.StatusConflict)
+	}
+}
+
+func TestReconcileKeepsTrashedAlbums(t *testing.T) {
+	h := newTestHandler(t)
+
+	trashed := h.seed(t, "c1", "agent", "sales")
+	lead := h.seedLead(t, trashed, "l1", "b1", "img1")
+	now := time.Now()
+	trashed.DeletedAt = &now
+	if err := h.saveCustomer(trashed); err != nil {
+		t.Fatal(err)
+	}
+
+	cus := h.seed(t, "c2", "agent", "sales")
+	unknown := h.seedLead(t, cus, "l2", "gone", "img2")
+
+	report, err := h.reconcileAlbums(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, issue := range report.Issues {
+		switch {
+		case issue.Kind == AlbumIssueOrphaned:
+			t.Errorf("album %s of a trashed customer reported orphaned", issue.AlbumID)
+		case issue.LeadID == "l2" && issue.Kind != AlbumIssueUnchecked:
+			t.Errorf("lead of a removed bikip reported %q, want %q", issue.Kind, AlbumIssueUnchecked)
+		}
+	}
+	for _, albumId := range []string{trashed.Album, leadAlbumOf(lead)} {
+		if h.photos.Album(albumId) == nil {
+			t.Errorf("album %s of a trashed customer deleted", albumId)
+		}
+	}
+	if album := h.photos.Album(leadAlbumOf(unknown)); album == nil || album.Name != "LEAD - l2" {
+		t.Errorf("lead album = %+v, want it left alone", album)
+	}
+}
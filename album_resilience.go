@@ -0,0 +1,182 @@
+package handler
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("photo service unavailable, try again later")
+
+// isPermanentAlbumError reports errors a retry cannot fix.
+func isPermanentAlbumError(err error) bool {
+	return errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrAlbumNotFound) || isRejectedAlbumError(err)
+}
+
+// retryPolicy retries a call with exponential backoff and jitter.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+func (p retryPolicy) do(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < p.attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.backoff(attempt))
+		}
+		err = fn()
+		if err == nil || isPermanentAlbumError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the wait before the given retry: the exponential delay
+// capped at max, half of it randomised.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.base << uint(attempt-1)
+	if d <= 0 || d > p.max {
+		d = p.max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// circuitBreaker fails calls fast once threshold calls in a row have failed.
+// After cooldown a single probe call is let through to test the service.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) call(fn func() error) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	// The service answered, a refused request says nothing of its health.
+	if err == nil || errors.Is(err, ErrAlbumNotFound) || isRejectedAlbumError(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// resilientAlbumService guards an AlbumService with the circuit breaker and
+// retries the idempotent calls. CreateAlbum is never retried since a lost
+// answer would leave a duplicate album behind.
+type resilientAlbumService struct {
+	next    AlbumService
+	retry   retryPolicy
+	breaker *circuitBreaker
+}
+
+func (r *resilientAlbumService) idempotent(fn func() error) error {
+	return r.retry.do(func() error {
+		return r.breaker.call(fn)
+	})
+}
+
+func (r *resilientAlbumService) CreateAlbum(apiKey, name, desc, parent, password string) (string, error) {
+	var albumId string
+	err := r.breaker.call(func() error {
+		var err error
+		albumId, err = r.next.CreateAlbum(apiKey, name, desc, parent, password)
+		return err
+	})
+	return albumId, err
+}
+
+func (r *resilientAlbumService) MoveImages(apiKey string, imageIds []string, albumId string) error {
+	return r.idempotent(func() error {
+		return r.next.MoveImages(apiKey, imageIds, albumId)
+	})
+}
+
+// UploadImage is not retried, a lost answer would store the photo twice.
+func (r *resilientAlbumService) UploadImage(apiKey, albumId, filename string, data []byte) (string, error) {
+	var imageId string
+	err := r.breaker.call(func() error {
+		var err error
+		imageId, err = r.next.UploadImage(apiKey, albumId, filename, data)
+		return err
+	})
+	return imageId, err
+}
+
+func (r *resilientAlbumService) RenameAlbum(apiKey, albumId, name, desc string) error {
+	return r.idempotent(func() error {
+		return r.next.RenameAlbum(apiKey, albumId, name, desc)
+	})
+}
+
+func (r *resilientAlbumService) SetAlbumPassword(apiKey, albumId, password string) error {
+	return r.idempotent(func() error {
+		return r.next.SetAlbumPassword(apiKey, albumId, password)
+	})
+}
+
+func (r *resilientAlbumService) DeleteAlbum(apiKey, albumId string) error {
+	return r.idempotent(func() error {
+		return r.next.DeleteAlbum(apiKey, albumId)
+	})
+}
+
+func (r *resilientAlbumService) TransferAlbum(apiKey, albumId, toKey string) error {
+	return r.idempotent(func() error {
+		return r.next.TransferAlbum(apiKey, albumId, toKey)
+	})
+}
+
+func (r *resilientAlbumService) GetAlbum(apiKey, albumId string) (*Album, error) {
+	var album *Album
+	err := r.idempotent(func() error {
+		var err error
+		album, err = r.next.GetAlbum(apiKey, albumId)
+		return err
+	})
+	return album, err
+}
+
+func (r *resilientAlbumService) ListAlbums(apiKey string) ([]*Album, error) {
+	var albums []*Album
+	err := r.idempotent(func() error {
+		var err error
+		albums, err = r.next.ListAlbums(apiKey)
+		return err
+	})
+	return albums, err
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.com/daitheky/api-portal-admin/repository"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: 20 * time.Millisecond}
+	failure := errors.New("photo service down")
+	calls := 0
+	fail := func() error { calls++; return failure }
+	succeed := func() error { calls++; return nil }
+
+	b.call(fail)
+	b.call(fail)
+	if err := b.call(succeed); err != ErrCircuitOpen {
+		t.Fatalf("open breaker: error = %v, want ErrCircuitOpen", err)
+	}
+	if calls != 2 {
+		t.Fatalf("open breaker let a call through, calls = %d", calls)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.call(fail); err != failure {
+		t.Fatalf("probe: error = %v, want the failure", err)
+	}
+	if err := b.call(succeed); err != ErrCircuitOpen {
+		t.Fatalf("failed probe: error = %v, want ErrCircuitOpen", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.call(succeed); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	if err := b.call(succeed); err != nil {
+		t.Fatalf("closed breaker: %v", err)
+	}
+}
+
+func TestCircuitBreakerNotFoundIsHealthy(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	for i := 0; i < 5; i++ {
+		b.call(func() error { return ErrAlbumNotFound })
+	}
+	if err := b.call(func() error { return nil }); err != nil {
+		t.Fatalf("a missing album opened the breaker: %v", err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := retryPolicy{attempts: 3, base: time.Millisecond, max: 2 * time.Millisecond}
+
+	calls := 0
+	err := p.do(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("timeout")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("do = %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	p.do(func() error { calls++; return ErrAlbumNotFound })
+	if calls != 1 {
+		t.Fatalf("a permanent error was retried %d times", calls-1)
+	}
+}
+
+func TestRejectedAlbumRequests(t *testing.T) {
+	var status int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		w.Write([]byte(`{"error": "refused"}`))
+	}))
+	defer srv.Close()
+	photos := newHTTPAlbumService(&repository.Config{AlbumAPI: srv.URL, PhotoAPI: srv.URL})
+
+	tests := []struct {
+		status   int
+		rejected bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusForbidden, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&status, int32(tt.status))
+		err := photos.RenameAlbum("key-a", "a1", "x", "")
+		if err == nil {
+			t.Errorf("%d: no error", tt.status)
+			continue
+		}
+		if got := isRejectedAlbumError(err); got != tt.rejected {
+			t.Errorf("%d: rejected = %v, want %v", tt.status, got, tt.rejected)
+		}
+	}
+
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	if err := photos.RenameAlbum("key-a", "a1", "x", ""); !errors.Is(err, ErrAlbumNotFound) || isRejectedAlbumError(err) {
+		t.Errorf("404 = %v, want ErrAlbumNotFound", err)
+	}
+}
+
+func TestRejectedRequestIsNotRetried(t *testing.T) {
+	rejected := &albumStatusError{status: http.StatusBadRequest, body: "invalid album"}
+
+	b := &circuitBreaker{threshold: 2, cooldown: time.Minute}
+	for i := 0; i < 5; i++ {
+		b.call(func() error { return rejected })
+	}
+	if err := b.call(func() error { return nil }); err != nil {
+		t.Fatalf("refused requests opened the breaker: %v", err)
+	}
+
+	p := retryPolicy{attempts: 3, base: time.Millisecond, max: 2 * time.Millisecond}
+	calls := 0
+	if err := p.do(func() error { calls++; return rejected }); err != rejected || calls != 1 {
+		t.Fatalf("do = %v after %d calls, want the refusal after 1", err, calls)
+	}
+
+	calls = 0
+	unavailable := &albumStatusError{status: http.StatusServiceUnavailable, body: "maintenance"}
+	p.do(func() error { calls++; return unavailable })
+	if calls != 3 {
+		t.Fatalf("a 503 was tried %d times, want 3", calls)
+	}
+}
@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"gitlab.com/daitheky/api-portal-admin/repository"
+)
+
+const (
+	defaultAlbumAPI = "https://album.daitheky.net/api/1"
+	defaultPhotoAPI = "https://api-dtk.thangbk.com/photos"
+)
+
+var ErrAlbumNotFound = errors.New("album not found")
+
+// albumStatusError is an answer of the photo service other than 200 and 404.
+type albumStatusError struct {
+	status int
+	body   string
+}
+
+func (e *albumStatusError) Error() string {
+	return e.body
+}
+
+// isRejectedAlbumError reports a request the photo service refused, a 4xx
+// answer sending it again cannot change. Timeouts and rate limits pass.
+func isRejectedAlbumError(err error) bool {
+	var statusErr *albumStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return statusErr.status >= 400 && statusErr.status < 500
+}
+
+// Album is an album as stored on the photo service.
+type Album struct {
+	ID         string
+	Name       string
+	Desc       string
+	Parent     string
+	ImageCount int
+}
+
+// AlbumService is the photo service holding customer and lead albums. Every
+// call is made on behalf of the owner of apiKey.
+type AlbumService interface {
+	// CreateAlbum creates an album protected by password, nested under parent
+	// when it is not empty, and returns its id.
+	CreateAlbum(apiKey, name, desc, parent, password string) (string, error)
+	// MoveImages moves photos into an album, filed under the customer category.
+	MoveImages(apiKey string, imageIds []string, albumId string) error
+	// UploadImage stores a photo in an album, filed under the customer
+	// category, and returns its id.
+	UploadImage(apiKey, albumId, filename string, data []byte) (string, error)
+	RenameAlbum(apiKey, albumId, name, desc string) error
+	SetAlbumPassword(apiKey, albumId, password string) error
+	DeleteAlbum(apiKey, albumId string) error
+	// TransferAlbum hands an album over to the owner of toKey.
+	TransferAlbum(apiKey, albumId, toKey string) error
+	// GetAlbum returns an album, ErrAlbumNotFound only when the photo
+	// service says it does not exist.
+	GetAlbum(apiKey, albumId string) (*Album, error)
+	// ListAlbums returns every album owned by apiKey.
+	ListAlbums(apiKey string) ([]*Album, error)
+}
+
+// httpAlbumService is safe for concurrent use: its client is configured once
+// and only requests carry per-call settings.
+type httpAlbumService struct {
+	client   *resty.Client
+	albumAPI string
+	photoAPI string
+	timeout  time.Duration
+}
+
+// NewAlbumService returns the photo service client for the endpoints of
+// config, with retries and a circuit breaker in front of it.
+func NewAlbumService(config *repository.Config) AlbumService {
+	return &resilientAlbumService{
+		next:  newHTTPAlbumService(config),
+		retry: albumRetryPolicy(config),
+		breaker: &circuitBreaker{
+			threshold: defaultInt(config.AlbumBreakerThreshold, 5),
+			cooldown:  defaultDuration(config.AlbumBreakerCooldown, 30*time.Second),
+		},
+	}
+}
+
+func albumRetryPolicy(config *repository.Config) retryPolicy {
+	return retryPolicy{
+		attempts: defaultInt(config.AlbumRetries, 3),
+		base:     defaultDuration(config.AlbumRetryDelay, 200*time.Millisecond),
+		max:      defaultDuration(config.AlbumRetryMaxDelay, 5*time.Minute),
+	}
+}
+
+func defaultInt(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func defaultInt64(v, def int64) int64 {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func defaultDuration(v, def time.Duration) time.Duration {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func newHTTPAlbumService(config *repository.Config) *httpAlbumService {
+	albumAPI := strings.TrimRight(config.AlbumAPI, "/")
+	if len(albumAPI) == 0 {
+		albumAPI = defaultAlbumAPI
+	}
+	photoAPI := strings.TrimRight(config.PhotoAPI, "/")
+	if len(photoAPI) == 0 {
+		photoAPI = defaultPhotoAPI
+	}
+
+	timeout := defaultDuration(config.AlbumTimeout, 10*time.Second)
+	client := resty.New().
+		SetTLSClientConfig(&tls.Config{InsecureSkipVerify: config.AlbumInsecureTLS}).
+		SetTimeout(timeout)
+
+	return &httpAlbumService{
+		client:   client,
+		albumAPI: albumAPI,
+		photoAPI: photoAPI,
+		timeout:  timeout,
+	}
+}
+
+func (h *httpAlbumService) post(endpoint string, data map[string]string, values url.Values) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	req := h.client.R().SetContext(ctx).SetFormData(data)
+	if values != nil {
+		req.SetFormDataFromValues(values)
+	}
+
+	resp, err := req.Post(endpoint)
+	return decodeAlbumResponse(resp, err)
+}
+
+func (h *httpAlbumService) get(endpoint string, params map[string]string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	resp, err := h.client.R().SetContext(ctx).SetQueryParams(params).Get(endpoint)
+	return decodeAlbumResponse(resp, err)
+}
+
+func decodeAlbumResponse(resp *resty.Response, err error) (map[string]interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, ErrAlbumNotFound
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, &albumStatusError{status: resp.StatusCode(), body: string(resp.Body())}
+	}
+
+	var res = make(map[string]interface{})
+	if len(resp.Body()) == 0 {
+		return res, nil
+	}
+	if err := json.Unmarshal(resp.Body(), &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *httpAlbumService) CreateAlbum(apiKey, name, desc, parent, password string) (string, error) {
+	data := map[string]string{
+		"key":                apiKey,
+		"type":               "album",
+		"album[name]":        name,
+		"album[description]": desc,
+		"album[privacy]":     "password",
+		"album[password]":    password,
+		"album[new]":         "true",
+	}
+	if len(parent) > 0 {
+		data["album[parent_id]"] = parent
+	}
+
+	res, err := h.post(h.albumAPI+"/create-album", data, nil)
+	if err != nil {
+		return "", err
+	}
+
+	album, ok := res["album"].(map[string]interface{})
+	if !ok {
+		return "", errors.New("cannot create album")
+	}
+	if albumId, ok := album["id_encoded"].(string); ok {
+		return albumId, nil
+	}
+
+	return "", errors.New("cannot create album")
+}
+
+func (h *httpAlbumService) MoveImages(apiKey string, imageIds []string, albumId string) error {
+	data := map[string]string{
+		"key":                  apiKey,
+		"editing[album_id]":    albumId,
+		"editing[category_id]": "7", // 2 category tuan123
+		"edit":                 "image",
+	}
+
+	_, err := h.post(h.photoAPI+"/edit", data, url.Values{
+		"editing[ids][]": imageIds,
+	})
+	return err
+}
+
+func (h *httpAlbumService) UploadImage(apiKey, albumId, filename string, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	form := map[string]string{
+		"key":         apiKey,
+		"category_id": "7",
+	}
+	if len(albumId) > 0 {
+		form["album_id"] = albumId
+	}
+
+	resp, err := h.client.R().
+		SetContext(ctx).
+		SetFormData(form).
+		SetFileReader("source", filename, bytes.NewReader(data)).
+		Post(h.albumAPI + "/upload")
+	res, err := decodeAlbumResponse(resp, err)
+	if err != nil {
+		return "", err
+	}
+
+	image, ok := res["image"].(map[string]interface{})
+	if !ok {
+		return "", errors.New("cannot upload image")
+	}
+	if imageId, ok := image["id_encoded"].(string); ok {
+		return imageId, nil
+	}
+	return "", errors.New("cannot upload image")
+}
+
+func (h *httpAlbumService) RenameAlbum(apiKey, albumId, name, desc string) error {
+	data := map[string]string{
+		"key":                apiKey,
+		"album_id":           albumId,
+		"album[name]":        name,
+		"album[description]": desc,
+	}
+
+	_, err := h.post(h.albumAPI+"/edit-album", data, nil)
+	return err
+}
+
+func (h *httpAlbumService) SetAlbumPassword(apiKey, albumId, password string) error {
+	data := map[string]string{
+		"key":             apiKey,
+		"album_id":        albumId,
+		"album[privacy]":  "password",
+		"album[password]": password,
+	}
+
+	_, err := h.post(h.albumAPI+"/edit-album", data, nil)
+	return err
+}
+
+func (h *httpAlbumService) DeleteAlbum(apiKey, albumId string) error {
+	data := map[string]string{
+		"key":      apiKey,
+		"album_id": albumId,
+	}
+
+	_, err := h.post(h.albumAPI+"/delete-album", data, nil)
+	return err
+}
+
+func (h *httpAlbumService) TransferAlbum(apiKey, albumId, toKey string) error {
+	data := map[string]string{
+		"key":      apiKey,
+		"album_id": albumId,
+		"to_key":   toKey,
+	}
+
+	_, err := h.post(h.albumAPI+"/transfer-album", data, nil)
+	return err
+}
+
+func (h *httpAlbumService) GetAlbum(apiKey, albumId string) (*Album, error) {
+	res, err := h.get(h.albumAPI+"/album", map[string]string{
+		"key":      apiKey,
+		"album_id": albumId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A 404 is the only answer meaning the album is gone: an album of
+	// another account, just transferred for example, comes back without it.
+	album, ok := res["album"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("cannot get album " + albumId)
+	}
+	return parseAlbum(album), nil
+}
+
+func (h *httpAlbumService) ListAlbums(apiKey string) ([]*Album, error) {
+	res, err := h.get(h.albumAPI+"/albums", map[string]string{
+		"key": apiKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items, _ := res["albums"].([]interface{})
+	albums := make([]*Album, 0, len(items))
+	for _, item := range items {
+		if album, ok := item.(map[string]interface{}); ok {
+			albums = append(albums, parseAlbum(album))
+		}
+	}
+	return albums, nil
+}
+
+func parseAlbum(album map[string]interface{}) *Album {
+	res := &Album{}
+	res.ID, _ = album["id_encoded"].(string)
+	res.Name, _ = album["name"].(string)
+	res.Desc, _ = album["description"].(string)
+	res.Parent, _ = album["parent_id_encoded"].(string)
+	if count, ok := album["image_count"].(float64); ok {
+		res.ImageCount = int(count)
+	}
+	return res
+}
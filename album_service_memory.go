@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// errAlbumNotOwned is returned by MemoryAlbumService for an album, or a
+// photo in an album, of another account.
+var errAlbumNotOwned = errors.New("album belongs to another account")
+
+// MemoryAlbum is an album kept by MemoryAlbumService.
+type MemoryAlbum struct {
+	ID       string
+	Owner    string
+	Name     string
+	Desc     string
+	Parent   string
+	Password string
+	Images   []string
+}
+
+// MemoryAlbumService is an in-memory AlbumService, used to run the handler
+// without the photo service.
+type MemoryAlbumService struct {
+	mu     sync.Mutex
+	albums map[string]*MemoryAlbum
+}
+
+func NewMemoryAlbumService() *MemoryAlbumService {
+	return &MemoryAlbumService{
+		albums: make(map[string]*MemoryAlbum),
+	}
+}
+
+// Album returns a copy of an album, nil when it does not exist.
+func (m *MemoryAlbumService) Album(albumId string) *MemoryAlbum {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, ok := m.albums[albumId]
+	if !ok {
+		return nil
+	}
+	res := *album
+	res.Images = append([]string(nil), album.Images...)
+	return &res
+}
+
+// owned returns the album of apiKey with id albumId.
+func (m *MemoryAlbumService) owned(apiKey, albumId string) (*MemoryAlbum, error) {
+	album, ok := m.albums[albumId]
+	if !ok {
+		return nil, ErrAlbumNotFound
+	}
+	if album.Owner != apiKey {
+		return nil, errAlbumNotOwned
+	}
+	return album, nil
+}
+
+// Len returns the number of albums.
+func (m *MemoryAlbumService) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.albums)
+}
+
+func (m *MemoryAlbumService) CreateAlbum(apiKey, name, desc, parent, password string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(parent) > 0 {
+		if _, err := m.owned(apiKey, parent); err != nil {
+			return "", err
+		}
+	}
+
+	album := &MemoryAlbum{
+		ID:       uuid.New().String(),
+		Owner:    apiKey,
+		Name:     name,
+		Desc:     desc,
+		Parent:   parent,
+		Password: password,
+	}
+	m.albums[album.ID] = album
+	return album.ID, nil
+}
+
+func (m *MemoryAlbumService) MoveImages(apiKey string, imageIds []string, albumId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var album *MemoryAlbum
+	if len(albumId) > 0 {
+		var err error
+		if album, err = m.owned(apiKey, albumId); err != nil {
+			return err
+		}
+	}
+
+	moved := make(map[string]bool, len(imageIds))
+	for _, id := range imageIds {
+		moved[id] = true
+	}
+	for _, a := range m.albums {
+		for _, id := range a.Images {
+			if moved[id] && a.Owner != apiKey {
+				return errAlbumNotOwned
+			}
+		}
+	}
+	for _, a := range m.albums {
+		images := a.Images[:0]
+		for _, id := range a.Images {
+			if !moved[id] {
+				images = append(images, id)
+			}
+		}
+		a.Images = images
+	}
+
+	if album != nil {
+		album.Images = append(album.Images, imageIds...)
+	}
+	return nil
+}
+
+func (m *MemoryAlbumService) UploadImage(apiKey, albumId, filename string, data []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	imageId := uuid.New().String()
+	if len(albumId) == 0 {
+		return imageId, nil
+	}
+
+	album, err := m.owned(apiKey, albumId)
+	if err != nil {
+		return "", err
+	}
+	album.Images = append(album.Images, imageId)
+	return imageId, nil
+}
+
+func (m *MemoryAlbumService) RenameAlbum(apiKey, albumId, name, desc string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.owned(apiKey, albumId)
+	if err != nil {
+		return err
+	}
+	album.Name = name
+	album.Desc = desc
+	return nil
+}
+
+func (m *MemoryAlbumService) SetAlbumPassword(apiKey, albumId, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.owned(apiKey, albumId)
+	if err != nil {
+		return err
+	}
+	album.Password = password
+	return nil
+}
+
+func (m *MemoryAlbumService) DeleteAlbum(apiKey, albumId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.owned(apiKey, albumId); err != nil {
+		return err
+	}
+	delete(m.albums, albumId)
+	return nil
+}
+
+func (m *MemoryAlbumService) TransferAlbum(apiKey, albumId, toKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.owned(apiKey, albumId)
+	if err != nil {
+		return err
+	}
+	album.Owner = toKey
+	return nil
+}
+
+func (m *MemoryAlbumService) GetAlbum(apiKey, albumId string) (*Album, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	album, err := m.owned(apiKey, albumId)
+	if err != nil {
+		return nil, err
+	}
+	return album.toAlbum(), nil
+}
+
+func (m *MemoryAlbumService) ListAlbums(apiKey string) ([]*Album, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	albums := make([]*Album, 0)
+	for _, album := range m.albums {
+		if album.Owner == apiKey {
+			albums = append(albums, album.toAlbum())
+		}
+	}
+	return albums, nil
+}
+
+func (a *MemoryAlbum) toAlbum() *Album {
+	return &Album{
+		ID:         a.ID,
+		Name:       a.Name,
+		Desc:       a.Desc,
+		Parent:     a.Parent,
+		ImageCount: len(a.Images),
+	}
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMemoryAlbumServiceOwnership(t *testing.T) {
+	m := NewMemoryAlbumService()
+	albumId, err := m.CreateAlbum("key-a", "KH - c1", "", "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageId, err := m.UploadImage("key-a", albumId, "photo.jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := map[string]func() error{
+		"CreateAlbum": func() error {
+			_, err := m.CreateAlbum("key-b", "LEAD", "", albumId, "secret")
+			return err
+		},
+		"MoveImages into": func() error {
+			return m.MoveImages("key-b", nil, albumId)
+		},
+		"MoveImages out of": func() error {
+			return m.MoveImages("key-b", []string{imageId}, "")
+		},
+		"UploadImage": func() error {
+			_, err := m.UploadImage("key-b", albumId, "photo.jpg", nil)
+			return err
+		},
+		"RenameAlbum":      func() error { return m.RenameAlbum("key-b", albumId, "x", "") },
+		"SetAlbumPassword": func() error { return m.SetAlbumPassword("key-b", albumId, "x") },
+		"TransferAlbum":    func() error { return m.TransferAlbum("key-b", albumId, "key-b") },
+		"DeleteAlbum":      func() error { return m.DeleteAlbum("key-b", albumId) },
+		"GetAlbum": func() error {
+			_, err := m.GetAlbum("key-b", albumId)
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, errAlbumNotOwned) {
+			t.Errorf("%s by another account = %v, want %v", name, err, errAlbumNotOwned)
+		}
+	}
+
+	album := m.Album(albumId)
+	if album == nil || album.Owner != "key-a" || album.Name != "KH - c1" || len(album.Images) != 1 {
+		t.Errorf("album = %+v, want it untouched", album)
+	}
+
+	if err := m.TransferAlbum("key-a", albumId, "key-b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RenameAlbum("key-b", albumId, "x", ""); err != nil {
+		t.Errorf("RenameAlbum by the new owner = %v", err)
+	}
+}
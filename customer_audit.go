@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	AuditCustomerCreate   = "customer.create"
+	AuditCustomerUpdate   = "customer.update"
+	AuditCustomerStatus   = "customer.status"
+	AuditCustomerDelete   = "customer.delete"
+	AuditCustomerRestore  = "customer.restore"
+	AuditCustomerMerge    = "customer.merge"
+	AuditCustomerTransfer = "customer.transfer"
+	AuditLeadCreate       = "lead.create"
+	AuditLeadUpdate       = "lead.update"
+	AuditLeadDelete       = "lead.delete"
+)
+
+// auditIgnoredFields are derived or bookkeeping fields that would only add
+// noise to a diff, or secrets that must not be copied into the log, the
+// encrypted phone and CMND and their hashes included.
+var auditIgnoredFields = []string{
+	"updated_at", "version", "user", "dept", "lead", "bikip", "album_password",
+	"phone", "last_cmnd", "phone_hash", "cmnd_hash", "phone_prefixes",
+	"search_name", "search_text",
+}
+
+// snapshot captures the json view of a record so later in-place mutations do
+// not leak into the "before" side of a diff.
+func snapshot(v interface{}) map[string]interface{} {
+	if rv := reflect.ValueOf(v); !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	var res = make(map[string]interface{})
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil
+	}
+	return res
+}
+
+// diffSnapshots lists the fields whose value differs between two snapshots.
+func diffSnapshots(before, after map[string]interface{}) []*entity.AuditChange {
+	keys := make(map[string]bool)
+	for k := range before {
+		keys[k] = true
+	}
+	for k := range after {
+		keys[k] = true
+	}
+
+	fields := make([]string, 0, len(keys))
+	for k := range keys {
+		if !cutils.Contains(auditIgnoredFields, k) {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := make([]*entity.AuditChange, 0)
+	for _, field := range fields {
+		if reflect.DeepEqual(before[field], after[field]) {
+			continue
+		}
+		changes = append(changes, &entity.AuditChange{
+			Field:  field,
+			Before: before[field],
+			After:  after[field],
+		})
+	}
+	return changes
+}
+
+// audit appends one entry to the customer's history. Failing to write the
+// entry never fails the request that made the change.
+func (s *CustomerHandlerImpl) audit(userInfo *auth.Claims, action, customerId, targetId string, before map[string]interface{}, after interface{}) {
+	entry := &entity.AuditLog{
+		ID:         uuid.New().String(),
+		CustomerID: customerId,
+		TargetID:   targetId,
+		Action:     action,
+		ActorID:    userInfo.ID,
+		ActorDept:  userInfo.Dept,
+		Changes:    diffSnapshots(before, snapshot(after)),
+		CreatedAt:  time.Now().Round(time.Second),
+	}
+
+	if err := s.auditRepo.Add(entry); err != nil {
+		log.Println("audit", action, customerId, err)
+	}
+}
+
+// History returns the audit trail of a customer, newest first.
+func (s *CustomerHandlerImpl) History(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
+	id := c.Param("id")
+	candidate, err := s.repo.GetByID(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+
+	if !policyFor(userInfo).CanView(candidate) {
+		return forbiddenCustomer(c)
+	}
+
+	var request QueryCustomer
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+		})
+	}
+	items, count, err := s.auditRepo.List(id, request.Offset, pageLimit(request.Limit))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data: map[string]interface{}{
+			"items": items,
+			"total": count,
+		},
+	})
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	before := map[string]interface{}{
+		"full_name": "Nguyễn Văn An", "city": "HCM", "note": "x",
+		"version": 1.0, "search_name": "nguyen van an", "phone_hash": "a", "updated_at": "t1",
+	}
+	after := map[string]interface{}{
+		"full_name": "Nguyễn Văn Anh", "city": "HCM", "address": "Quận 1",
+		"version": 2.0, "search_name": "nguyen van anh", "phone_hash": "b", "updated_at": "t2",
+	}
+
+	changes := diffSnapshots(before, after)
+	want := []struct {
+		field         string
+		before, after interface{}
+	}{
+		{"address", nil, "Quận 1"},
+		{"full_name", "Nguyễn Văn An", "Nguyễn Văn Anh"},
+		{"note", "x", nil},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes, want %d", len(changes), len(want))
+	}
+	for i, w := range want {
+		got := changes[i]
+		if got.Field != w.field || got.Before != w.before || got.After != w.after {
+			t.Errorf("change %d = %+v, want %+v", i, got, w)
+		}
+	}
+
+	if changes := diffSnapshots(nil, map[string]interface{}{"city": "HCM"}); len(changes) != 1 || changes[0].Before != nil {
+		t.Errorf("creation = %+v, want the city added", changes)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.Update, user, http.MethodPut, `{"full_name": "Khách c1", "phone": "0901234589", "city": "HCM"}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Update = %d %s", res.Status, res.Message)
+	}
+
+	res = h.call(t, h.History, user, http.MethodGet, `{"limit": 100000}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("History = %d %s", res.Status, res.Message)
+	}
+	if h.audits.lastLimit != maxPageSize {
+		t.Errorf("History asked for %d entries, want at most %d", h.audits.lastLimit, maxPageSize)
+	}
+
+	var data struct {
+		Items []struct {
+			Action  string `json:"action"`
+			Changes []struct {
+				Field string `json:"field"`
+			} `json:"changes"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(res.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Items) != 1 || data.Items[0].Action != AuditCustomerUpdate {
+		t.Fatalf("history = %+v, want the update", data.Items)
+	}
+	fields := make([]string, 0)
+	for _, change := range data.Items[0].Changes {
+		fields = append(fields, change.Field)
+	}
+	if len(fields) != 1 || fields[0] != "city" {
+		t.Errorf("changed fields = %v, want only city", fields)
+	}
+
+	res = h.call(t, h.History, agent("other", "rentals"), http.MethodGet, "", "id", "c1")
+	if res.Status != http.StatusForbidden {
+		t.Errorf("History of another user's customer = %d, want %d", res.Status, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"strings"
+	"unicode"
+
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+// maxDuplicateCandidates bounds how many existing customers are fetched per
+// lookup when checking a new customer for duplicates.
+const maxDuplicateCandidates = 20
+
+// findDuplicates returns the live customers sharing the phone number or CMND
+// of a new customer, and apart from those the ones whose name is nearly the
+// same and whose birth year matches when both are known. Common names are
+// shared by different people, so only the first are duplicates.
+func (s *CustomerHandlerImpl) findDuplicates(fullName, phone, cmnd string, birthYear int) ([]*entity.Customer, []*entity.Customer, error) {
+	found := make(map[string]*entity.Customer)
+	add := func(to *[]*entity.Customer, customers []*entity.Customer, match func(cus *entity.Customer) bool) {
+		for _, cus := range customers {
+			if _, ok := found[cus.ID]; ok || cus.DeletedAt != nil || !match(cus) {
+				continue
+			}
+			found[cus.ID] = cus
+			*to = append(*to, cus)
+		}
+	}
+
+	duplicates := make([]*entity.Customer, 0)
+	similar := make([]*entity.Customer, 0)
+
+	if normPhone := normalizePhone(phone); len(normPhone) > 0 {
+		phoneHash := s.cipher.hashIdentity("phone", normPhone)
+		customers, err := s.searchIdentity("phone_hash", phoneHash, "phone", []string{normPhone, phone})
+		if err != nil {
+			return nil, nil, err
+		}
+		add(&duplicates, customers, func(cus *entity.Customer) bool {
+			plainPhone, _ := s.identity(cus)
+			return cus.PhoneHash == phoneHash || normalizePhone(plainPhone) == normPhone
+		})
+	}
+
+	if normCMND := normalizeCMND(cmnd); len(normCMND) > 0 {
+		cmndHash := s.cipher.hashIdentity("cmnd", normCMND)
+		customers, err := s.searchIdentity("cmnd_hash", cmndHash, "last_cmnd", []string{normCMND, cmnd})
+		if err != nil {
+			return nil, nil, err
+		}
+		add(&duplicates, customers, func(cus *entity.Customer) bool {
+			_, plainCMND := s.identity(cus)
+			return cus.CMNDHash == cmndHash || normalizeCMND(plainCMND) == normCMND
+		})
+	}
+
+	if name := foldText(fullName); len(name) > 0 {
+		customers, err := s.searchCustomers(&fuzzyNameFilter{name: name}, "-_score,-created_at,id")
+		if err != nil {
+			return nil, nil, err
+		}
+		add(&similar, customers, func(cus *entity.Customer) bool {
+			if birthYear > 0 && cus.BirthYear > 0 && cus.BirthYear != birthYear {
+				return false
+			}
+			return similarName(cus.FullName, fullName)
+		})
+	}
+
+	return duplicates, similar, nil
+}
+
+// searchIdentity finds customers by the hash of an encrypted identity field,
+// and by plain text for the records stored before encryption.
+func (s *CustomerHandlerImpl) searchIdentity(hashField, hash, plainField string, plain []string) ([]*entity.Customer, error) {
+	customers, err := s.searchCustomers(Term(hashField, hash), "-created_at,id")
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := s.searchCustomers(TermsOf(plainField, plain), "-created_at,id")
+	if err != nil {
+		return nil, err
+	}
+	return append(customers, legacy...), nil
+}
+
+func (s *CustomerHandlerImpl) searchCustomers(filter Filter, sort string) ([]*entity.Customer, error) {
+	query := And(filter, notDeleted())
+
+	customers, _, err := s.repo.List(query, sort, 0, maxDuplicateCandidates)
+	return customers, err
+}
+
+// fuzzyNameFilter fetches the customers whose folded name matches every word
+// of name, allowing a typo or two per word. It only finds candidates,
+// similarName decides which are duplicates.
+type fuzzyNameFilter struct {
+	name string
+}
+
+func (f *fuzzyNameFilter) scores() bool {
+	return true
+}
+
+func (f *fuzzyNameFilter) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"match": map[string]interface{}{
+			"search_name": map[string]interface{}{
+				"query":     f.name,
+				"fuzziness": "AUTO",
+				"operator":  "and",
+			},
+		},
+	}, nil
+}
+
+// describeDuplicates lists who owns the conflicting customers so the agent
+// knows whom to contact.
+func (s *CustomerHandlerImpl) describeDuplicates(duplicates []*entity.Customer) []map[string]interface{} {
+	conflicts := make([]map[string]interface{}, 0, len(duplicates))
+	for _, cus := range duplicates {
+		conflict := map[string]interface{}{
+			"id":         cus.ID,
+			"full_name":  cus.FullName,
+			"created_at": cus.CreatedAt,
+		}
+
+		if u, err := s.userRepo.GetByID(cus.UserID); err == nil {
+			conflict["user"] = &entity.User{
+				ID:       u.ID,
+				FullName: u.FullName,
+				DeptName: u.DeptName,
+				Phone:    u.Phone,
+			}
+		}
+		if dept, err := s.deptRepo.GetByID(cus.DeptID); err == nil {
+			conflict["dept"] = dept
+		}
+
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts
+}
+
+// normalizePhone keeps the digits of a phone number, "+84 90..." and "090..."
+// both become "090...".
+func normalizePhone(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+
+	if strings.HasPrefix(digits, "84") && len(digits) > 10 {
+		digits = "0" + digits[2:]
+	}
+	return digits
+}
+
+func normalizeCMND(cmnd string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return -1
+	}, cmnd)
+}
+
+// similarName reports whether two names differ by at most one typo for every
+// ten characters, ignoring case and accents.
+func similarName(a, b string) bool {
+	ra := []rune(foldText(a))
+	rb := []rune(foldText(b))
+	if len(ra) == 0 || len(rb) == 0 {
+		return false
+	}
+
+	maxLen := len(ra)
+	if len(rb) > maxLen {
+		maxLen = len(rb)
+	}
+	return levenshtein(ra, rb) <= 1+maxLen/10
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,62 @@
+package handler
+
+import "testing"
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+		{"nguyen", "nguyen", 0},
+		{"nguyen", "ngyuen", 2},
+		{"tran", "tram", 1},
+		{"lê", "le", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSimilarName(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"Nguyễn Văn An", "nguyen van an", true},
+		{"Nguyễn Văn An", "Nguyen  Van  An.", true},
+		{"Nguyễn Văn An", "Nguyễn Văn Ân", true},
+		{"Nguyễn Văn An", "Nguyễn Văn Anh", true},
+		{"Nguyễn Văn An", "Trần Thị Bình", false},
+		{"Lê Anh", "Lê Bình", false},
+		{"", "", false},
+		{"Nguyễn Văn An", "", false},
+	}
+	for _, tt := range tests {
+		if got := similarName(tt.a, tt.b); got != tt.want {
+			t.Errorf("similarName(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone, want string
+	}{
+		{"0901 234 589", "0901234589"},
+		{"+84 901 234 589", "0901234589"},
+		{"84901234589", "0901234589"},
+		{"(090) 123-4589", "0901234589"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizePhone(tt.phone); got != tt.want {
+			t.Errorf("normalizePhone(%q) = %q, want %q", tt.phone, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const facetSize = 50
+
+// defaultBudgetBuckets are the budget boundaries, in billion VND, used when
+// the config sets none.
+var defaultBudgetBuckets = []float64{1, 2, 3, 5, 10}
+
+// facetFields lists the fields the customer list can count by.
+var facetFields = map[string]bool{
+	"districts": true,
+	"status":    true,
+	"budget":    true,
+	"dept_id":   true,
+	"user_id":   true,
+}
+
+// Facet counts customers per value of a field. Source renders it as a search
+// backend aggregation; the repository runs the aggregations by name and
+// returns the count of every bucket key.
+type Facet struct {
+	Name    string
+	field   string
+	buckets []budgetBucket
+}
+
+type budgetBucket struct {
+	key  string
+	from *float64
+	to   *float64
+}
+
+func (f *Facet) Source() (interface{}, error) {
+	if len(f.buckets) == 0 {
+		return map[string]interface{}{
+			"terms": map[string]interface{}{
+				"field": f.field,
+				"size":  facetSize,
+			},
+		}, nil
+	}
+
+	ranges := make([]interface{}, 0, len(f.buckets))
+	for _, b := range f.buckets {
+		r := map[string]interface{}{"key": b.key}
+		if b.from != nil {
+			r["from"] = *b.from
+		}
+		if b.to != nil {
+			r["to"] = *b.to
+		}
+		ranges = append(ranges, r)
+	}
+	return map[string]interface{}{
+		"range": map[string]interface{}{
+			"field":  f.field,
+			"ranges": ranges,
+		},
+	}, nil
+}
+
+// FacetBucket is one value of a facet and how many customers have it.
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// budgetBuckets turns sorted boundaries into ranges: below the first, between
+// each pair, and from the last upwards.
+func budgetBuckets(bounds []float64) []budgetBucket {
+	if len(bounds) == 0 {
+		return nil
+	}
+
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	buckets := make([]budgetBucket, 0, len(bounds)+1)
+	for i := 0; i <= len(bounds); i++ {
+		var b budgetBucket
+		switch {
+		case i == 0:
+			b.to = &bounds[0]
+			b.key = "<" + format(bounds[0])
+		case i == len(bounds):
+			b.from = &bounds[i-1]
+			b.key = ">=" + format(bounds[i-1])
+		default:
+			b.from, b.to = &bounds[i-1], &bounds[i]
+			b.key = format(bounds[i-1]) + "-" + format(bounds[i])
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// parseFacets reads a list such as "districts,status,budget".
+func (s *CustomerHandlerImpl) parseFacets(names string) ([]*Facet, error) {
+	facets := make([]*Facet, 0)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 || seen[name] {
+			continue
+		}
+		if !facetFields[name] {
+			return nil, fmt.Errorf("cannot count by %q", name)
+		}
+		seen[name] = true
+
+		facet := &Facet{Name: name, field: name}
+		if name == "budget" {
+			facet.buckets = budgetBuckets(s.budgetBuckets)
+		}
+		facets = append(facets, facet)
+	}
+	return facets, nil
+}
+
+// customerFacets counts the customers matching query for each facet. Terms
+// are ordered by count, budget ranges in ascending order.
+func (s *CustomerHandlerImpl) customerFacets(query Filter, facets []*Facet) (map[string][]FacetBucket, error) {
+	result := make(map[string][]FacetBucket)
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	aggs := make(map[string]interface{}, len(facets))
+	for _, facet := range facets {
+		source, err := facet.Source()
+		if err != nil {
+			return nil, err
+		}
+		aggs[facet.Name] = source
+	}
+
+	counts, err := s.repo.Facets(query, aggs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, facet := range facets {
+		buckets := make([]FacetBucket, 0)
+		if len(facet.buckets) > 0 {
+			for _, b := range facet.buckets {
+				buckets = append(buckets, FacetBucket{Value: b.key, Count: counts[facet.Name][b.key]})
+			}
+		} else {
+			for value, count := range counts[facet.Name] {
+				buckets = append(buckets, FacetBucket{Value: value, Count: count})
+			}
+			sort.Slice(buckets, func(i, j int) bool {
+				if buckets[i].Count != buckets[j].Count {
+					return buckets[i].Count > buckets[j].Count
+				}
+				return buckets[i].Value < buckets[j].Value
+			})
+		}
+		result[facet.Name] = buckets
+	}
+	return result, nil
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseFacets(t *testing.T) {
+	h := newTestHandler(t)
+
+	tests := []struct {
+		names string
+		want  []string
+		err   bool
+	}{
+		{"", []string{}, false},
+		{"districts", []string{"districts"}, false},
+		{" status , budget,status,, dept_id", []string{"status", "budget", "dept_id"}, false},
+		{"user_id,phone", nil, true},
+		{"full_name", nil, true},
+	}
+	for _, tt := range tests {
+		facets, err := h.parseFacets(tt.names)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseFacets(%q) accepted", tt.names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseFacets(%q) = %v", tt.names, err)
+			continue
+		}
+		got := make([]string, 0, len(facets))
+		for _, facet := range facets {
+			got = append(got, facet.Name)
+			if (facet.Name == "budget") != (len(facet.buckets) > 0) {
+				t.Errorf("parseFacets(%q): %s has %d buckets", tt.names, facet.Name, len(facet.buckets))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFacets(%q) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestBudgetBuckets(t *testing.T) {
+	if buckets := budgetBuckets(nil); buckets != nil {
+		t.Errorf("budgetBuckets(nil) = %v, want none", buckets)
+	}
+
+	bound := func(v *float64) interface{} {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	want := []struct {
+		key      string
+		from, to interface{}
+	}{
+		{"<1", nil, 1.0},
+		{"1-2.5", 1.0, 2.5},
+		{"2.5-10", 2.5, 10.0},
+		{">=10", 10.0, nil},
+	}
+	buckets := budgetBuckets([]float64{1, 2.5, 10})
+	if len(buckets) != len(want) {
+		t.Fatalf("got %d buckets, want %d", len(buckets), len(want))
+	}
+	for i, w := range want {
+		b := buckets[i]
+		if b.key != w.key || bound(b.from) != w.from || bound(b.to) != w.to {
+			t.Errorf("bucket %d = %s [%v, %v), want %s [%v, %v)", i, b.key, bound(b.from), bound(b.to), w.key, w.from, w.to)
+		}
+	}
+}
+
+func TestCustomerFacets(t *testing.T) {
+	h := newTestHandler(t)
+	customers := []struct {
+		id        string
+		status    int
+		districts []string
+		budget    []float32
+	}{
+		{"c1", 1, []string{"Quận 1", "Quận 3"}, []float32{0.5}},
+		{"c2", 2, []string{"Quận 3"}, []float32{1.5, 2}},
+		{"c3", 2, []string{"Quận 7"}, []float32{12}},
+		{"c4", 1, []string{"Quận 3", "Quận 7"}, nil},
+	}
+	for _, c := range customers {
+		cus := h.seed(t, c.id, "agent", "sales")
+		cus.Status = c.status
+		cus.Districts = c.districts
+		cus.Budget = c.budget
+		if err := h.saveCustomer(cus); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := h.call(t, h.List, agent("agent", "sales"), http.MethodGet, `{"facets": "districts,status,budget"}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("List = %d %s", res.Status, res.Message)
+	}
+	var data struct {
+		Facets map[string][]FacetBucket `json:"facets"`
+	}
+	if err := json.Unmarshal(res.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]FacetBucket{
+		// By count, then by value.
+		"districts": {{"Quận 3", 3}, {"Quận 7", 2}, {"Quận 1", 1}},
+		"status":    {{"1", 2}, {"2", 2}},
+		// In range order, empty ranges included.
+		"budget": {{"<1", 1}, {"1-2", 1}, {"2-3", 1}, {"3-5", 0}, {"5-10", 0}, {">=10", 1}},
+	}
+	if !reflect.DeepEqual(data.Facets, want) {
+		t.Errorf("facets = %v, want %v", data.Facets, want)
+	}
+
+	res = h.call(t, h.List, agent("agent", "sales"), http.MethodGet, `{"facets": "phone"}`)
+	if res.Status != http.StatusBadRequest {
+		t.Errorf("List by an unknown facet = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,766 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+	"gitlab.com/daitheky/api-portal-admin/repository"
+)
+
+var errNotFound = errors.New("not found")
+
+// fakeCustomerRepo keeps customers and leads in memory. Queries are matched
+// on their term, terms, range and exists clauses; text searches match
+// everything, so callers still confirm candidates themselves.
+type fakeCustomerRepo struct {
+	mu        sync.Mutex
+	customers map[string]*entity.Customer
+	leads     map[string]*entity.CustomerLead
+
+	// failAddLead and failDeleteLead make the next calls fail.
+	failAddLead    error
+	failDeleteLead error
+
+	// lastSort is the sort of the last ListPage.
+	lastSort string
+}
+
+func newFakeCustomerRepo() *fakeCustomerRepo {
+	return &fakeCustomerRepo{
+		customers: make(map[string]*entity.Customer),
+		leads:     make(map[string]*entity.CustomerLead),
+	}
+}
+
+func copyCustomer(cus *entity.Customer) *entity.Customer {
+	dup := *cus
+	dup.StatusHistory = append([]*entity.CustomerStatusChange(nil), cus.StatusHistory...)
+	dup.Transfers = append([]*entity.CustomerTransfer(nil), cus.Transfers...)
+	return &dup
+}
+
+func (r *fakeCustomerRepo) GetByID(id string) (*entity.Customer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cus, ok := r.customers[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return copyCustomer(cus), nil
+}
+
+func (r *fakeCustomerRepo) Create(cus *entity.Customer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.customers[cus.ID] = copyCustomer(cus)
+	return nil
+}
+
+func (r *fakeCustomerRepo) UpdateIfVersion(cus *entity.Customer, expected int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.customers[cus.ID]
+	if !ok {
+		return errNotFound
+	}
+	if stored.Version != expected {
+		return repository.ErrVersionConflict
+	}
+	r.customers[cus.ID] = copyCustomer(cus)
+	return nil
+}
+
+func (r *fakeCustomerRepo) Delete(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.customers, id)
+	return nil
+}
+
+func (r *fakeCustomerRepo) search(query repository.Query) ([]*entity.Customer, error) {
+	source, err := query.Source()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	customers := make([]*entity.Customer, 0)
+	for _, cus := range r.customers {
+		if matchQuery(source, cus) {
+			customers = append(customers, copyCustomer(cus))
+		}
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		if !customers[i].CreatedAt.Equal(customers[j].CreatedAt) {
+			return customers[i].CreatedAt.After(customers[j].CreatedAt)
+		}
+		return customers[i].ID < customers[j].ID
+	})
+	return customers, nil
+}
+
+func (r *fakeCustomerRepo) Count(query repository.Query) (int64, error) {
+	customers, err := r.search(query)
+	return int64(len(customers)), err
+}
+
+func (r *fakeCustomerRepo) List(query repository.Query, sort string, offset, limit int) ([]*entity.Customer, int64, error) {
+	customers, err := r.search(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := int64(len(customers))
+	from, to := window(len(customers), offset, limit)
+	return customers[from:to], total, nil
+}
+
+func (r *fakeCustomerRepo) ListPage(query repository.Query, sort string, after []interface{}, offset, limit int) ([]*entity.Customer, int64, []interface{}, error) {
+	customers, err := r.search(query)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	r.mu.Lock()
+	r.lastSort = sort
+	r.mu.Unlock()
+
+	// Customers are always in -created_at,id order here, the cursor holds
+	// the creation time in milliseconds and the ID like the search backend.
+	total := int64(len(customers))
+	if len(after) == 2 {
+		offset = len(customers)
+		for i, cus := range customers {
+			if sortsAfter(cus, after) {
+				offset = i
+				break
+			}
+		}
+	}
+	from, to := window(len(customers), offset, limit)
+	items := customers[from:to]
+
+	var last []interface{}
+	if len(items) > 0 {
+		cus := items[len(items)-1]
+		last = []interface{}{cus.CreatedAt.UnixNano() / int64(time.Millisecond), cus.ID}
+	}
+	return items, total, last, nil
+}
+
+// sortsAfter reports whether a customer comes after a cursor in -created_at,id
+// order. Cursors decoded from a token hold float64 numbers.
+func sortsAfter(cus *entity.Customer, after []interface{}) bool {
+	var at int64
+	switch v := after[0].(type) {
+	case int64:
+		at = v
+	case float64:
+		at = int64(v)
+	}
+	id, _ := after[1].(string)
+
+	created := cus.CreatedAt.UnixNano() / int64(time.Millisecond)
+	return created < at || created == at && cus.ID > id
+}
+
+// Facets runs terms and range aggregations over the matching customers. A
+// customer counts once per bucket, whatever the number of its values in it.
+func (r *fakeCustomerRepo) Facets(query repository.Query, aggs map[string]interface{}) (map[string]map[string]int64, error) {
+	customers, err := r.search(query)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, _ := json.Marshal(aggs)
+	var specs map[string]struct {
+		Terms *struct {
+			Field string `json:"field"`
+		} `json:"terms"`
+		Range *struct {
+			Field  string `json:"field"`
+			Ranges []struct {
+				Key  string   `json:"key"`
+				From *float64 `json:"from"`
+				To   *float64 `json:"to"`
+			} `json:"ranges"`
+		} `json:"range"`
+	}
+	if err := json.Unmarshal(raw, &specs); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]map[string]int64)
+	for name, spec := range specs {
+		counts[name] = make(map[string]int64)
+		for _, cus := range customers {
+			raw, _ := json.Marshal(cus)
+			var doc map[string]interface{}
+			_ = json.Unmarshal(raw, &doc)
+
+			switch {
+			case spec.Terms != nil:
+				keys := make(map[string]bool)
+				for _, value := range fieldValues(doc[spec.Terms.Field]) {
+					keys[fmt.Sprint(value)] = true
+				}
+				for key := range keys {
+					counts[name][key]++
+				}
+			case spec.Range != nil:
+				for _, bucket := range spec.Range.Ranges {
+					for _, value := range fieldValues(doc[spec.Range.Field]) {
+						v, ok := value.(float64)
+						if ok && (bucket.From == nil || v >= *bucket.From) && (bucket.To == nil || v < *bucket.To) {
+							counts[name][bucket.Key]++
+							break
+						}
+					}
+				}
+			}
+		}
+	}
+	return counts, nil
+}
+
+// fieldValues returns the values of a document field, one for a scalar.
+func fieldValues(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{value}
+}
+
+func (r *fakeCustomerRepo) AddLead(leads []*entity.CustomerLead) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failAddLead != nil {
+		return r.failAddLead
+	}
+	for _, lead := range leads {
+		r.leads[lead.ID] = copyLead(lead)
+	}
+	return nil
+}
+
+func (r *fakeCustomerRepo) GetLead(id string) (*entity.CustomerLead, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lead, ok := r.leads[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return copyLead(lead), nil
+}
+
+func (r *fakeCustomerRepo) DeleteLead(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failDeleteLead != nil {
+		return r.failDeleteLead
+	}
+	delete(r.leads, id)
+	return nil
+}
+
+func (r *fakeCustomerRepo) customerLeads(cid string) []*entity.CustomerLead {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	leads := make([]*entity.CustomerLead, 0)
+	for _, lead := range r.leads {
+		if lead.CID == cid {
+			leads = append(leads, copyLead(lead))
+		}
+	}
+	sort.Slice(leads, func(i, j int) bool {
+		if !leads[i].RegAt.Equal(leads[j].RegAt) {
+			return leads[i].RegAt.After(leads[j].RegAt)
+		}
+		return leads[i].ID < leads[j].ID
+	})
+	return leads
+}
+
+func (r *fakeCustomerRepo) ListLead(cid string, offset, limit int) ([]*entity.CustomerLead, int64, error) {
+	leads := r.customerLeads(cid)
+	from, to := window(len(leads), offset, limit)
+	return leads[from:to], int64(len(leads)), nil
+}
+
+func (r *fakeCustomerRepo) ListLeadPage(cid string, after []interface{}, offset, limit int) ([]*entity.CustomerLead, int64, []interface{}, error) {
+	leads := r.customerLeads(cid)
+	from, to := window(len(leads), offset, limit)
+	items := leads[from:to]
+
+	var last []interface{}
+	if len(items) > 0 {
+		last = []interface{}{items[len(items)-1].ID}
+	}
+	return items, int64(len(leads)), last, nil
+}
+
+// window returns the bounds of the page starting at offset.
+func window(n, offset, limit int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+	end := n
+	if limit > 0 && offset+limit < n {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// matchQuery evaluates the clauses of a rendered filter the fake understands
+// against a customer.
+func matchQuery(source interface{}, cus *entity.Customer) bool {
+	raw, _ := json.Marshal(cus)
+	var doc map[string]interface{}
+	_ = json.Unmarshal(raw, &doc)
+
+	raw, _ = json.Marshal(source)
+	var query map[string]interface{}
+	_ = json.Unmarshal(raw, &query)
+
+	return matchClause(query, doc)
+}
+
+func matchClause(query map[string]interface{}, doc map[string]interface{}) bool {
+	for kind, body := range query {
+		clause, _ := body.(map[string]interface{})
+		switch kind {
+		case "bool":
+			for _, occur := range []string{"filter", "must"} {
+				for _, child := range clauses(clause[occur]) {
+					if !matchClause(child, doc) {
+						return false
+					}
+				}
+			}
+			for _, child := range clauses(clause["must_not"]) {
+				if matchClause(child, doc) {
+					return false
+				}
+			}
+			if should := clauses(clause["should"]); len(should) > 0 {
+				matched := false
+				for _, child := range should {
+					matched = matched || matchClause(child, doc)
+				}
+				if !matched {
+					return false
+				}
+			}
+		case "term":
+			for field, value := range clause {
+				if inner, ok := value.(map[string]interface{}); ok {
+					value = inner["value"]
+				}
+				if !fieldHas(doc[field], value) {
+					return false
+				}
+			}
+		case "terms":
+			for field, values := range clause {
+				matched := false
+				for _, value := range values.([]interface{}) {
+					matched = matched || fieldHas(doc[field], value)
+				}
+				if !matched {
+					return false
+				}
+			}
+		case "exists":
+			if value, ok := doc[clause["field"].(string)]; !ok || value == nil {
+				return false
+			}
+		case "range":
+			for field, bounds := range clause {
+				value, ok := doc[field].(float64)
+				if !ok {
+					return false
+				}
+				for op, bound := range bounds.(map[string]interface{}) {
+					b := bound.(float64)
+					if (op == "gt" && value <= b) || (op == "gte" && value < b) ||
+						(op == "lt" && value >= b) || (op == "lte" && value > b) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return true
+}
+
+func clauses(value interface{}) []map[string]interface{} {
+	items, _ := value.([]interface{})
+	res := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if clause, ok := item.(map[string]interface{}); ok {
+			res = append(res, clause)
+		}
+	}
+	return res
+}
+
+func fieldHas(field, value interface{}) bool {
+	want, _ := json.Marshal(value)
+	if values, ok := field.([]interface{}); ok {
+		for _, v := range values {
+			if got, _ := json.Marshal(v); string(got) == string(want) {
+				return true
+			}
+		}
+		return false
+	}
+	got, _ := json.Marshal(field)
+	return string(got) == string(want)
+}
+
+type fakeApiKeyRepo struct {
+	mu      sync.Mutex
+	missing map[string]bool
+}
+
+// GetBy returns the key "key-<user id>", unless the user is marked missing.
+func (r *fakeApiKeyRepo) GetBy(field, value string) (*entity.ApiKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.missing[value] {
+		return nil, errNotFound
+	}
+	return &entity.ApiKey{ID: "key-" + value, UserID: value}, nil
+}
+
+type fakeUserRepo struct {
+	users map[string]*entity.User
+}
+
+func (r *fakeUserRepo) GetByID(id string) (*entity.User, error) {
+	if u, ok := r.users[id]; ok {
+		return u, nil
+	}
+	return nil, errNotFound
+}
+
+type fakeDeptRepo struct{}
+
+func (r *fakeDeptRepo) GetByID(id string) (*entity.Dept, error) {
+	return nil, errNotFound
+}
+
+type fakeBikipRepo struct {
+	bikips map[string]*entity.Bikip
+}
+
+func (r *fakeBikipRepo) Get(id string) (*entity.Bikip, error) {
+	if b, ok := r.bikips[id]; ok {
+		return b, nil
+	}
+	return nil, errNotFound
+}
+
+type fakeAuditRepo struct {
+	mu   sync.Mutex
+	logs []*entity.AuditLog
+
+	// lastLimit is the limit of the last List.
+	lastLimit int
+}
+
+func (r *fakeAuditRepo) Add(log *entity.AuditLog) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.logs = append(r.logs, log)
+	return nil
+}
+
+func (r *fakeAuditRepo) List(customerID string, offset, limit int) ([]*entity.AuditLog, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastLimit = limit
+	logs := make([]*entity.AuditLog, 0)
+	for _, l := range r.logs {
+		if l.CustomerID == customerID {
+			logs = append(logs, l)
+		}
+	}
+	from, to := window(len(logs), offset, limit)
+	return logs[from:to], int64(len(logs)), nil
+}
+
+type noopValidator struct{}
+
+func (noopValidator) Validate(i interface{}) error {
+	return nil
+}
+
+// testHandler is a CustomerHandlerImpl wired to in-memory repositories and
+// photo service, with the album worker running.
+type testHandler struct {
+	*CustomerHandlerImpl
+	customers *fakeCustomerRepo
+	apiKeys   *fakeApiKeyRepo
+	users     *fakeUserRepo
+	bikips    *fakeBikipRepo
+	audits    *fakeAuditRepo
+	photos    *MemoryAlbumService
+	echo      *echo.Echo
+}
+
+func newTestHandler(t *testing.T) *testHandler {
+	t.Helper()
+
+	cipher, err := newFieldCipher("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &testHandler{
+		customers: newFakeCustomerRepo(),
+		apiKeys:   &fakeApiKeyRepo{missing: make(map[string]bool)},
+		users: &fakeUserRepo{users: map[string]*entity.User{
+			"agent":  {ID: "agent", FullName: "Agent", DeptID: "sales"},
+			"agent2": {ID: "agent2", FullName: "Agent 2", DeptID: "sales"},
+			"other":  {ID: "other", FullName: "Other", DeptID: "rentals"},
+		}},
+		bikips: &fakeBikipRepo{bikips: map[string]*entity.Bikip{
+			"b1": {ID: "b1", Title: "Căn hộ Quận 1 giá 5 tỷ"},
+			"b2": {ID: "b2", Title: "Nhà phố Quận 3 giá 9 tỷ"},
+		}},
+		audits: &fakeAuditRepo{},
+		photos: NewMemoryAlbumService(),
+		echo:   echo.New(),
+	}
+	h.echo.Validator = noopValidator{}
+
+	h.CustomerHandlerImpl = &CustomerHandlerImpl{
+		repo:      h.customers,
+		userRepo:  h.users,
+		deptRepo:  &fakeDeptRepo{},
+		bikipRepo: h.bikips,
+		apiRepo:   h.apiKeys,
+		auditRepo: h.audits,
+		albums:    h.photos,
+		cipher:    cipher,
+		albumName: newAlbumNamer("", ""),
+
+		maxImageSize: defaultMaxImageSize,
+
+		statusTransitions: DefaultStatusTransitions,
+		budgetBuckets:     defaultBudgetBuckets,
+	}
+	h.albumQueue = newAlbumQueue(retryPolicy{attempts: 1, base: time.Millisecond, max: 5 * time.Millisecond}, h.provisionAlbums, h.failAlbums)
+	h.albumQueue.start(2)
+	return h
+}
+
+func agent(id, dept string, perms ...string) *auth.Claims {
+	return &auth.Claims{ID: id, Dept: dept, Perms: perms}
+}
+
+type testResponse struct {
+	Status  int
+	Header  http.Header
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// call runs a handler method with a JSON body and the path parameters given
+// as name, value pairs.
+func (h *testHandler) call(t *testing.T, fn func(echo.Context) error, user *auth.Claims, method, body string, params ...string) testResponse {
+	t.Helper()
+
+	res, err := h.do(fn, user, method, body, params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// callWithHeader is call with extra request headers.
+func (h *testHandler) callWithHeader(t *testing.T, fn func(echo.Context) error, user *auth.Claims, header http.Header, method, body string, params ...string) testResponse {
+	t.Helper()
+
+	res, err := h.send(fn, user, header, method, body, params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// do is call for goroutines other than the test's own.
+func (h *testHandler) do(fn func(echo.Context) error, user *auth.Claims, method, body string, params ...string) (testResponse, error) {
+	return h.send(fn, user, nil, method, body, params...)
+}
+
+func (h *testHandler) send(fn func(echo.Context) error, user *auth.Claims, header http.Header, method, body string, params ...string) (testResponse, error) {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+
+	c := h.echo.NewContext(req, rec)
+	c.Set(constant.KeyUserInfo, user)
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	if err := fn(c); err != nil {
+		return testResponse{}, fmt.Errorf("handler error: %v", err)
+	}
+
+	res := testResponse{Status: rec.Code, Header: rec.Header()}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		return testResponse{}, fmt.Errorf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return res, nil
+}
+
+// seed stores a customer owned by userId in dept, with its albums ready.
+func (h *testHandler) seed(t *testing.T, id, userId, dept string) *entity.Customer {
+	t.Helper()
+
+	albumId, err := h.photos.CreateAlbum("key-"+userId, "KH - "+id, id, "", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := h.cipher.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cus := &entity.Customer{
+		ID:            id,
+		FullName:      "Khách " + id,
+		UserID:        userId,
+		DeptID:        dept,
+		Album:         albumId,
+		AlbumPassword: password,
+		Version:       1,
+		CreatedAt:     time.Now().Round(time.Second),
+	}
+	if err := h.customers.Create(cus); err != nil {
+		t.Fatal(err)
+	}
+	return cus
+}
+
+// seedLead stores a lead of a customer with its photos in their own album.
+func (h *testHandler) seedLead(t *testing.T, cus *entity.Customer, id, bikipId string, images ...string) *entity.CustomerLead {
+	t.Helper()
+
+	albumId, err := h.photos.CreateAlbum("key-"+cus.UserID, "LEAD - "+id, bikipId, cus.Album, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.photos.MoveImages("key-"+cus.UserID, images, albumId); err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := h.cipher.Encrypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lead := &entity.CustomerLead{
+		ID:            id,
+		CID:           cus.ID,
+		UserID:        cus.UserID,
+		BikipID:       bikipId,
+		Comment:       "first visit",
+		AlbumPassword: password,
+		RegAt:         time.Now().Round(time.Second),
+	}
+	for _, image := range images {
+		lead.Images = append(lead.Images, &entity.Image{GalleryID: image, Album: albumId})
+	}
+	if err := h.customers.AddLead([]*entity.CustomerLead{lead}); err != nil {
+		t.Fatal(err)
+	}
+	return lead
+}
+
+// waitAlbums waits for the album worker to finish with a customer and its
+// leads.
+func (h *testHandler) waitAlbums(t *testing.T, id string) *entity.Customer {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cus, err := h.customers.GetByID(id)
+		if err == nil && cus.AlbumStatus != AlbumStatusPending && !h.albumsPending(id) {
+			return cus
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("albums of %s still pending", id)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// albumsPending reports whether a customer has a job queued or running, or a
+// lead waiting for its album.
+func (h *testHandler) albumsPending(id string) bool {
+	h.albumQueue.mu.Lock()
+	_, queued := h.albumQueue.state[id]
+	h.albumQueue.mu.Unlock()
+	if queued {
+		return true
+	}
+
+	for _, lead := range h.customers.customerLeads(id) {
+		if lead.AlbumStatus == AlbumStatusPending {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyCustomer returns the single customer stored, failing otherwise.
+func (h *testHandler) onlyCustomer(t *testing.T) *entity.Customer {
+	t.Helper()
+
+	h.customers.mu.Lock()
+	defer h.customers.mu.Unlock()
+
+	if len(h.customers.customers) != 1 {
+		t.Fatalf("got %d customers, want 1", len(h.customers.customers))
+	}
+	for _, cus := range h.customers.customers {
+		return copyCustomer(cus)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Filter is a typed condition on customers. Source renders it as a search
+// backend query, so the repository can use it as is.
+type Filter interface {
+	Source() (interface{}, error)
+}
+
+// scoringFilter is a filter whose matches are ranked, so And keeps its score.
+type scoringFilter interface {
+	scores() bool
+}
+
+// filterScores reports whether a filter ranks its matches.
+func filterScores(filter Filter) bool {
+	scoring, ok := filter.(scoringFilter)
+	return ok && scoring.scores()
+}
+
+type boolFilter struct {
+	occur   string
+	filters []Filter
+}
+
+// And matches customers that satisfy every filter; nil filters are skipped.
+func And(filters ...Filter) Filter {
+	return &boolFilter{occur: "filter", filters: filters}
+}
+
+// Or matches customers that satisfy at least one filter.
+func Or(filters ...Filter) Filter {
+	return &boolFilter{occur: "should", filters: filters}
+}
+
+// Not matches customers that do not satisfy the filter.
+func Not(filter Filter) Filter {
+	return &boolFilter{occur: "must_not", filters: []Filter{filter}}
+}
+
+// scores reports whether any clause ranks its matches, so a parent And keeps
+// the score of nested ones. Excluded matches are never ranked.
+func (f *boolFilter) scores() bool {
+	if f.occur == "must_not" {
+		return false
+	}
+	for _, filter := range f.filters {
+		if filterScores(filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *boolFilter) Source() (interface{}, error) {
+	query := make(map[string]interface{})
+	for _, filter := range f.filters {
+		if filter == nil {
+			continue
+		}
+		source, err := filter.Source()
+		if err != nil {
+			return nil, err
+		}
+
+		occur := f.occur
+		if occur == "filter" && filterScores(filter) {
+			occur = "must"
+		}
+		clauses, _ := query[occur].([]interface{})
+		query[occur] = append(clauses, source)
+	}
+	if len(query) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+
+	if f.occur == "should" {
+		query["minimum_should_match"] = 1
+	}
+	return map[string]interface{}{"bool": query}, nil
+}
+
+type termFilter struct {
+	field string
+	value interface{}
+}
+
+func Term(field string, value interface{}) Filter {
+	return &termFilter{field: field, value: value}
+}
+
+func (f *termFilter) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"term": map[string]interface{}{f.field: f.value},
+	}, nil
+}
+
+type termsFilter struct {
+	field  string
+	values []interface{}
+}
+
+func Terms(field string, values ...interface{}) Filter {
+	return &termsFilter{field: field, values: values}
+}
+
+// TermsOf is Terms for a string slice.
+func TermsOf(field string, values []string) Filter {
+	items := make([]interface{}, len(values))
+	for i, v := range values {
+		items[i] = v
+	}
+	return Terms(field, items...)
+}
+
+func (f *termsFilter) Source() (interface{}, error) {
+	if len(f.values) == 0 {
+		return nil, fmt.Errorf("terms %s: no values", f.field)
+	}
+	return map[string]interface{}{
+		"terms": map[string]interface{}{f.field: f.values},
+	}, nil
+}
+
+// RangeFilter bounds a field; unset bounds are open.
+type RangeFilter struct {
+	field string
+	gt    interface{}
+	gte   interface{}
+	lt    interface{}
+	lte   interface{}
+}
+
+func Range(field string) *RangeFilter {
+	return &RangeFilter{field: field}
+}
+
+func (f *RangeFilter) Gt(v interface{}) *RangeFilter  { f.gt = v; return f }
+func (f *RangeFilter) Gte(v interface{}) *RangeFilter { f.gte = v; return f }
+func (f *RangeFilter) Lt(v interface{}) *RangeFilter  { f.lt = v; return f }
+func (f *RangeFilter) Lte(v interface{}) *RangeFilter { f.lte = v; return f }
+
+func (f *RangeFilter) Source() (interface{}, error) {
+	bounds := make(map[string]interface{})
+	for op, v := range map[string]interface{}{"gt": f.gt, "gte": f.gte, "lt": f.lt, "lte": f.lte} {
+		if v != nil {
+			bounds[op] = v
+		}
+	}
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("range %s: no bounds", f.field)
+	}
+	return map[string]interface{}{
+		"range": map[string]interface{}{f.field: bounds},
+	}, nil
+}
+
+type prefixFilter struct {
+	field  string
+	prefix string
+}
+
+func Prefix(field, prefix string) Filter {
+	return &prefixFilter{field: field, prefix: prefix}
+}
+
+func (f *prefixFilter) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"prefix": map[string]interface{}{f.field: f.prefix},
+	}, nil
+}
+
+type wildcardFilter struct {
+	field   string
+	pattern string
+}
+
+// Wildcard matches a pattern where * is any run of characters and ? any one,
+// ignoring case.
+func Wildcard(field, pattern string) Filter {
+	return &wildcardFilter{field: field, pattern: pattern}
+}
+
+func (f *wildcardFilter) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"wildcard": map[string]interface{}{
+			f.field: map[string]interface{}{
+				"value":            f.pattern,
+				"case_insensitive": true,
+			},
+		},
+	}, nil
+}
+
+type existsFilter struct {
+	field string
+}
+
+func Exists(field string) Filter {
+	return &existsFilter{field: field}
+}
+
+func (f *existsFilter) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"exists": map[string]interface{}{"field": f.field},
+	}, nil
+}
+
+// notDeleted hides soft deleted customers.
+func notDeleted() Filter {
+	return Not(Exists("deleted_at"))
+}
+
+// customerFilter translates the list filters into a repository filter.
+func (s *CustomerHandlerImpl) customerFilter(request *QueryCustomer) Filter {
+	filters := make([]Filter, 0)
+
+	if len(request.Keyword) > 0 {
+		filters = append(filters, s.keywordSearch(request.Keyword))
+	}
+	if request.Status != nil {
+		filters = append(filters, Term("status", *request.Status))
+	}
+	if len(request.Districts) > 0 {
+		filters = append(filters, TermsOf("districts", request.Districts))
+	}
+	if len(request.Budget) > 0 {
+		budget := Range("budget").Gte(request.Budget[0])
+		if len(request.Budget) > 1 {
+			budget.Lte(request.Budget[1])
+		}
+		filters = append(filters, budget)
+	}
+	if len(request.Dept) > 0 {
+		filters = append(filters, Term("dept_id", request.Dept))
+	}
+	if len(request.User) > 0 {
+		filters = append(filters, Term("user_id", request.User))
+	}
+
+	return And(filters...)
+}
+
+const (
+	maxFilterDepth = 6
+	maxFilterNodes = 50
+)
+
+type fieldKind int
+
+const (
+	fieldKeyword fieldKind = iota
+	fieldNumber
+	fieldDate
+)
+
+// searchableFields lists what the advanced search may filter on. Encrypted
+// identity fields and album passwords are deliberately left out.
+var searchableFields = map[string]fieldKind{
+	"full_name":    fieldKeyword,
+	"districts":    fieldKeyword,
+	"city":         fieldKeyword,
+	"province":     fieldKeyword,
+	"dept_id":      fieldKeyword,
+	"user_id":      fieldKeyword,
+	"album_status": fieldKeyword,
+	"status":       fieldNumber,
+	"budget":       fieldNumber,
+	"birth_year":   fieldNumber,
+	"version":      fieldNumber,
+	"lead_at":      fieldDate,
+	"created_at":   fieldDate,
+	"updated_at":   fieldDate,
+	"deleted_at":   fieldDate,
+}
+
+// FilterNode is the JSON form of a filter, e.g.
+//
+//	{"op": "and", "filters": [
+//	    {"op": "keyword", "value": "nguyen van a"},
+//	    {"op": "terms", "field": "districts", "values": ["Quận 1", "Quận 3"]},
+//	    {"op": "not", "filters": [{"op": "term", "field": "status", "value": 4}]},
+//	    {"op": "range", "field": "budget", "gte": 2, "lte": 5}]}
+type FilterNode struct {
+	Op      string        `json:"op"`
+	Field   string        `json:"field,omitempty"`
+	Value   interface{}   `json:"value,omitempty"`
+	Values  []interface{} `json:"values,omitempty"`
+	Gt      interface{}   `json:"gt,omitempty"`
+	Gte     interface{}   `json:"gte,omitempty"`
+	Lt      interface{}   `json:"lt,omitempty"`
+	Lte     interface{}   `json:"lte,omitempty"`
+	Filters []*FilterNode `json:"filters,omitempty"`
+}
+
+// Filter validates the tree and builds the typed filter it describes; keyword
+// turns a keyword into its search.
+func (n *FilterNode) Filter(keyword func(string) Filter) (Filter, error) {
+	nodes := 0
+	return n.build(keyword, 1, &nodes)
+}
+
+func (n *FilterNode) build(keyword func(string) Filter, depth int, nodes *int) (Filter, error) {
+	if n == nil {
+		return nil, errors.New("empty filter")
+	}
+	*nodes++
+	if depth > maxFilterDepth {
+		return nil, fmt.Errorf("filter is nested deeper than %d levels", maxFilterDepth)
+	}
+	if *nodes > maxFilterNodes {
+		return nil, fmt.Errorf("filter has more than %d conditions", maxFilterNodes)
+	}
+
+	switch n.Op {
+	case "and", "or", "not":
+		if len(n.Filters) == 0 {
+			return nil, fmt.Errorf("%s: filters is required", n.Op)
+		}
+		if n.Op == "not" && len(n.Filters) != 1 {
+			return nil, errors.New("not: takes exactly one filter")
+		}
+		children := make([]Filter, 0, len(n.Filters))
+		for _, child := range n.Filters {
+			filter, err := child.build(keyword, depth+1, nodes)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, filter)
+		}
+		switch n.Op {
+		case "and":
+			return And(children...), nil
+		case "or":
+			return Or(children...), nil
+		}
+		return Not(children[0]), nil
+	case "keyword":
+		text, ok := n.Value.(string)
+		if !ok {
+			return nil, errors.New("keyword: value must be a string")
+		}
+		filter := keyword(text)
+		if filter == nil {
+			return nil, errors.New("keyword: nothing to search for")
+		}
+		return filter, nil
+	}
+
+	kind, ok := searchableFields[n.Field]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown field %q", n.Op, n.Field)
+	}
+
+	switch n.Op {
+	case "term":
+		if err := checkFilterValue(n.Field, kind, n.Value); err != nil {
+			return nil, err
+		}
+		return Term(n.Field, n.Value), nil
+	case "terms":
+		if len(n.Values) == 0 || len(n.Values) > maxFilterNodes {
+			return nil, fmt.Errorf("terms %s: expected 1 to %d values", n.Field, maxFilterNodes)
+		}
+		for _, v := range n.Values {
+			if err := checkFilterValue(n.Field, kind, v); err != nil {
+				return nil, err
+			}
+		}
+		return Terms(n.Field, n.Values...), nil
+	case "range":
+		if kind == fieldKeyword {
+			return nil, fmt.Errorf("range %s: field is not a number or date", n.Field)
+		}
+		if n.Gt == nil && n.Gte == nil && n.Lt == nil && n.Lte == nil {
+			return nil, fmt.Errorf("range %s: at least one bound is required", n.Field)
+		}
+		for _, v := range []interface{}{n.Gt, n.Gte, n.Lt, n.Lte} {
+			if v == nil {
+				continue
+			}
+			if err := checkFilterValue(n.Field, kind, v); err != nil {
+				return nil, err
+			}
+		}
+		return Range(n.Field).Gt(n.Gt).Gte(n.Gte).Lt(n.Lt).Lte(n.Lte), nil
+	case "prefix", "wildcard":
+		if kind != fieldKeyword {
+			return nil, fmt.Errorf("%s %s: field is not text", n.Op, n.Field)
+		}
+		pattern, ok := n.Value.(string)
+		if !ok || len(strings.Trim(pattern, "*?")) == 0 {
+			return nil, fmt.Errorf("%s %s: value must be a non-empty string", n.Op, n.Field)
+		}
+		if n.Op == "prefix" {
+			return Prefix(n.Field, pattern), nil
+		}
+		return Wildcard(n.Field, pattern), nil
+	case "exists":
+		return Exists(n.Field), nil
+	}
+
+	return nil, fmt.Errorf("unknown op %q", n.Op)
+}
+
+func checkFilterValue(field string, kind fieldKind, value interface{}) error {
+	switch value.(type) {
+	case string:
+		if kind != fieldNumber {
+			return nil
+		}
+	case float64:
+		if kind != fieldKeyword {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: invalid value %v", field, value)
+}
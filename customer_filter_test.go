@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func parseFilterNode(t *testing.T, raw string) *FilterNode {
+	t.Helper()
+
+	var node FilterNode
+	if err := json.Unmarshal([]byte(raw), &node); err != nil {
+		t.Fatalf("decode %s: %v", raw, err)
+	}
+	return &node
+}
+
+func testKeyword(text string) Filter {
+	if len(strings.TrimSpace(text)) == 0 {
+		return nil
+	}
+	return Term("search_text", text)
+}
+
+func TestFilterNode(t *testing.T) {
+	raw := `{"op": "and", "filters": [
+		{"op": "keyword", "value": "nguyen van a"},
+		{"op": "terms", "field": "districts", "values": ["Quận 1", "Quận 3"]},
+		{"op": "not", "filters": [{"op": "term", "field": "status", "value": 4}]},
+		{"op": "range", "field": "budget", "gte": 2, "lte": 5}]}`
+
+	filter, err := parseFilterNode(t, raw).Filter(testKeyword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := filter.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(source)
+
+	for _, part := range []string{
+		`{"term":{"search_text":"nguyen van a"}}`,
+		`{"terms":{"districts":["Quận 1","Quận 3"]}}`,
+		`"must_not":[{"term":{"status":4}}]`,
+		`{"range":{"budget":{"gte":2,"lte":5}}}`,
+	} {
+		if !strings.Contains(string(got), part) {
+			t.Errorf("filter %s does not contain %s", got, part)
+		}
+	}
+}
+
+func TestFilterNodeRejects(t *testing.T) {
+	deep := `{"op": "term", "field": "city", "value": "HCM"}`
+	for i := 0; i < maxFilterDepth; i++ {
+		deep = `{"op": "not", "filters": [` + deep + `]}`
+	}
+	wide := make([]string, maxFilterNodes)
+	for i := range wide {
+		wide[i] = `{"op": "exists", "field": "lead_at"}`
+	}
+
+	tests := []struct {
+		name, raw string
+	}{
+		{"unknown op", `{"op": "script", "field": "city"}`},
+		{"unknown field", `{"op": "term", "field": "phone", "value": "0901234589"}`},
+		{"encrypted field", `{"op": "exists", "field": "album_password"}`},
+		{"text for a number", `{"op": "term", "field": "status", "value": "new"}`},
+		{"number for text", `{"op": "term", "field": "city", "value": 1}`},
+		{"range on text", `{"op": "range", "field": "city", "gte": "a"}`},
+		{"range without bounds", `{"op": "range", "field": "budget"}`},
+		{"empty terms", `{"op": "terms", "field": "districts", "values": []}`},
+		{"empty and", `{"op": "and"}`},
+		{"not with two", `{"op": "not", "filters": [{"op": "exists", "field": "lead_at"}, {"op": "exists", "field": "lead_at"}]}`},
+		{"empty keyword", `{"op": "keyword", "value": "  "}`},
+		{"keyword not text", `{"op": "keyword", "value": 3}`},
+		{"bare wildcard", `{"op": "wildcard", "field": "full_name", "value": "**"}`},
+		{"wildcard on number", `{"op": "wildcard", "field": "budget", "value": "1*"}`},
+		{"too deep", deep},
+		{"too many", `{"op": "or", "filters": [` + strings.Join(wide, ",") + `]}`},
+	}
+	for _, tt := range tests {
+		if _, err := parseFilterNode(t, tt.raw).Filter(testKeyword); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
+
+func TestAndKeepsNestedScores(t *testing.T) {
+	keyword := &keywordFilter{text: "an"}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{"nested and", And(And(keyword, Term("city", "HCM")), Term("dept_id", "sales")),
+			`{"bool":{"filter":[{"term":{"dept_id":"sales"}}],"must":[{"bool":{"filter":[{"term":{"city":"HCM"}}],"must":[`},
+		{"or", And(Or(keyword, Term("city", "HCM")), Term("dept_id", "sales")),
+			`{"bool":{"filter":[{"term":{"dept_id":"sales"}}],"must":[{"bool":{"minimum_should_match":1,"should":[`},
+		{"not", And(Not(keyword), Term("dept_id", "sales")),
+			`{"bool":{"filter":[{"bool":{"must_not":[`},
+	}
+	for _, tt := range tests {
+		source, err := tt.filter.Source()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := json.Marshal(source)
+		if !strings.HasPrefix(string(got), tt.want) {
+			t.Errorf("%s: %s, want it to start with %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRelevanceSort(t *testing.T) {
+	keyword := &keywordFilter{text: "an"}
+
+	tests := []struct {
+		filter Filter
+		want   string
+	}{
+		{nil, "-lead_at"},
+		{And(Term("city", "HCM")), "-lead_at"},
+		{And(Not(keyword)), "-lead_at"},
+		{And(And(keyword), Term("city", "HCM")), "-relevance,-lead_at"},
+		{Or(Term("city", "HCM"), keyword), "-relevance,-lead_at"},
+	}
+	for i, tt := range tests {
+		if got := relevanceSort(tt.filter, "-lead_at"); got != tt.want {
+			t.Errorf("%d: relevanceSort = %q, want %q", i, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,11 @@
 package handler
 
 import (
-	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
-	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,7 +13,6 @@ import (
 
 	cutils "common-libraries/pkg/utils"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 	"github.com/panjf2000/ants/v2"
@@ -23,16 +20,30 @@ import (
 	"gitlab.com/daitheky/api-portal-admin/constant"
 	"gitlab.com/daitheky/api-portal-admin/entity"
 	"gitlab.com/daitheky/api-portal-admin/repository"
-	"gitlab.com/daitheky/api-portal-admin/utils"
 )
 
 type CustomerHandlerImpl struct {
-	repo       repository.CustomerRepository
-	userRepo   repository.UserRepository
-	deptRepo   repository.DeptRepository
-	bikipRepo  repository.BikipRepository
-	apiRepo    repository.ApiKeyRepository
-	httpClient *resty.Client
+	repo      customerStore
+	userRepo  repository.UserRepository
+	deptRepo  repository.DeptRepository
+	bikipRepo repository.BikipRepository
+	apiRepo   repository.ApiKeyRepository
+	auditRepo auditStore
+	albums    AlbumService
+	cipher    *fieldCipher
+	albumName *albumNamer
+
+	maxImageSize int64
+
+	albumQueue *albumQueue
+	leadLocks  leadLocks
+	// reconciling is 1 while an album reconciliation runs, rotating while
+	// album passwords are rotated.
+	reconciling int32
+	rotating    int32
+
+	statusTransitions map[int][]int
+	budgetBuckets     []float64
 }
 
 func NewCustomerHandler(config *repository.Config) CustomerHandler {
@@ -62,14 +73,50 @@ func NewCustomerHandler(config *repository.Config) CustomerHandler {
 		return nil
 	}
 
-	return &CustomerHandlerImpl{
-		repo:       repo,
-		userRepo:   userRepo,
-		deptRepo:   deptRepo,
-		bikipRepo:  bikipRepo,
-		apiRepo:    apiRepo,
-		httpClient: resty.New(),
+	auditRepo, err := repository.NewAuditRepositoryImpl(config)
+	if err != nil {
+		return nil
+	}
+
+	// Phone numbers and CMND are stored encrypted, the customer routes
+	// cannot run without the key.
+	secretCipher, err := newFieldCipher(config.SecretKey)
+	if err != nil {
+		log.Fatalln("customer handler: config SecretKey:", err)
+	}
+
+	statusTransitions := DefaultStatusTransitions
+	if len(config.StatusTransitions) > 0 {
+		statusTransitions = config.StatusTransitions
+	}
+
+	budgetBuckets := defaultBudgetBuckets
+	if len(config.BudgetBuckets) > 0 {
+		budgetBuckets = append([]float64(nil), config.BudgetBuckets...)
+		sort.Float64s(budgetBuckets)
+	}
+
+	handler := &CustomerHandlerImpl{
+		repo:      repo,
+		userRepo:  userRepo,
+		deptRepo:  deptRepo,
+		bikipRepo: bikipRepo,
+		apiRepo:   apiRepo,
+		auditRepo: auditRepo,
+		albums:    NewAlbumService(config),
+		cipher:    secretCipher,
+		albumName: newAlbumNamer(config.CustomerAlbumTemplate, config.LeadAlbumTemplate),
+
+		maxImageSize: defaultInt64(config.MaxImageSize, defaultMaxImageSize),
+
+		statusTransitions: statusTransitions,
+		budgetBuckets:     budgetBuckets,
 	}
+	handler.albumQueue = newAlbumQueue(albumRetryPolicy(config), handler.provisionAlbums, handler.failAlbums)
+	handler.albumQueue.start(defaultInt(config.AlbumWorkers, 4))
+	go handler.resumePendingAlbums()
+
+	return handler
 }
 
 func (s *CustomerHandlerImpl) bind(c echo.Context, pointer interface{}) error {
@@ -91,7 +138,9 @@ type QueryCustomer struct {
 	User      string    `param:"user" query:"user" form:"user" json:"user"`
 	Offset    int       `param:"offset" query:"offset" form:"offset" json:"offset"`
 	Limit     int       `param:"limit" query:"limit" form:"limit" json:"limit"`
+	Cursor    string    `param:"cursor" query:"cursor" form:"cursor" json:"cursor"`
 	Sort      string    `param:"sort" query:"sort" form:"sort" json:"sort"`
+	Facets    string    `param:"facets" query:"facets" form:"facets" json:"facets"`
 }
 
 func (s *CustomerHandlerImpl) List(c echo.Context) error {
@@ -112,80 +161,23 @@ func (s *CustomerHandlerImpl) List(c echo.Context) error {
 		})
 	}
 
-	query := make(map[string]map[string]interface{})
-
-	// if len(request.Value) > 0 {
-	// 	if err := json.Unmarshal([]byte(request.Value), &query); err != nil {
-	// 		return c.JSON(http.StatusBadRequest, Response{
-	// 			Code:    http.StatusBadRequest,
-	// 			Message: "Invalid params",
-	// 		})
-	// 	}
-	// }
-
-	if len(request.Keyword) > 0 {
-		query["keyword"] = map[string]interface{}{
-			"type":  "wildcard",
-			"value": request.Keyword,
-		}
-	}
-	if request.Status != nil {
-		query["status"] = map[string]interface{}{
-			"type":  "term",
-			"value": strconv.Itoa(*request.Status),
-		}
-	}
-	if request.Status != nil {
-		query["status"] = map[string]interface{}{
-			"type":  "term",
-			"value": strconv.Itoa(*request.Status),
-		}
-	}
-	if request.Districts != nil && len(request.Districts) > 0 {
-		query["districts"] = map[string]interface{}{
-			"type":  "terms",
-			"value": request.Districts,
-		}
-	}
-	if request.Budget != nil && len(request.Budget) > 0 {
-		query["budget"] = map[string]interface{}{
-			"type":  "range",
-			"value": request.Budget,
-		}
-	}
-	if len(request.Dept) > 0 {
-		query["dept_id"] = map[string]interface{}{
-			"type":  "term",
-			"value": request.Dept,
-		}
-	}
-	if len(request.User) > 0 {
-		query["user_id"] = map[string]interface{}{
-			"type":  "term",
-			"value": request.User,
-		}
+	filter := s.customerFilter(&request)
+	sortField, err := parseSort(request.Sort, relevanceSort(filter, "-lead_at"))
+	if err != nil {
+		return invalidSort(c, err)
 	}
 
-	canViewMember := cutils.Contains(userInfo.Perms, constant.PermMemberView) || cutils.Contains(userInfo.Perms, constant.PermAdminMemberView)
-	if len(request.User) > 0 && canViewMember {
-		query["user_id"] = map[string]interface{}{
-			"type":  "term",
-			"value": request.User,
-		}
-	}
-	if !canViewMember {
-		query["user_id"] = map[string]interface{}{
-			"type":  "term",
-			"value": userInfo.ID,
-		}
-	}
-	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
-		query["dept_id"] = map[string]interface{}{
-			"type":  "term",
-			"value": userInfo.Dept,
-		}
+	facets, err := s.parseFacets(request.Facets)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid facets",
+			Data:    err.Error(),
+		})
 	}
 
+	query := And(filter, policyFor(userInfo).Scope(), notDeleted())
+
 	count, err := s.repo.Count(query)
 	if err != nil {
 		return c.JSON(http.StatusOK, Response{
@@ -195,36 +187,58 @@ func (s *CustomerHandlerImpl) List(c echo.Context) error {
 		})
 	}
 
+	data := map[string]interface{}{
+		"items": []entity.Customer{},
+		"total": 0,
+	}
+	if len(facets) > 0 {
+		counts, err := s.customerFacets(query, facets)
+		if err != nil {
+			return c.JSON(http.StatusOK, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Not found",
+				Data:    err.Error(),
+			})
+		}
+		data["facets"] = counts
+	}
+
 	if count == 0 {
 		return c.JSON(http.StatusOK, Response{
 			Code:    http.StatusOK,
 			Message: "Success",
-			Data: map[string]interface{}{
-				"items": []entity.Customer{},
-				"total": 0,
-			},
+			Data:    data,
 		})
 	}
 
-	sortField := request.Sort
-	if sortField == "created" {
-		sortField = "created_at"
-	} else {
-		sortField = "lead_at"
-	}
-
-	customers, _, err := s.repo.List(query, sortField, request.Offset, request.Limit)
+	customers, next, err := s.listCustomers(query, sortField, request.Cursor, request.Offset, request.Limit)
 	if err != nil {
-		return c.JSON(http.StatusOK, Response{
-			Code:    http.StatusBadRequest,
-			Message: "Not found",
-			Data:    err.Error(),
-		})
+		return listError(c, err)
 	}
 
+	s.expandCustomers(customers)
+
+	data["items"] = customers
+	data["total"] = count
+	data["next_cursor"] = next
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data:    data,
+	})
+}
+
+// expandCustomers attaches the owner and latest leads to each customer and
+// hides what list views must not show.
+func (s *CustomerHandlerImpl) expandCustomers(customers []*entity.Customer) {
 	var wg sync.WaitGroup
 	p, _ := ants.NewPoolWithFunc(6, func(i interface{}) {
 		cus := i.(*entity.Customer)
+		defer wg.Done()
+		defer hideAlbumPasswords(cus)
+		defer s.maskIdentity(cus)
+
 		u, err := s.userRepo.GetByID(cus.UserID)
 		if err != nil {
 			return
@@ -257,7 +271,6 @@ func (s *CustomerHandlerImpl) List(c echo.Context) error {
 				Total: count,
 			}
 		}
-		wg.Done()
 	})
 
 	defer p.Release()
@@ -267,15 +280,6 @@ func (s *CustomerHandlerImpl) List(c echo.Context) error {
 	}
 
 	wg.Wait()
-
-	return c.JSON(http.StatusOK, Response{
-		Code:    http.StatusOK,
-		Message: "Success",
-		Data: map[string]interface{}{
-			"items": customers,
-			"total": count,
-		},
-	})
 }
 
 func (s *CustomerHandlerImpl) Add(c echo.Context) error {
@@ -298,15 +302,23 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 		})
 	}
 
-	// Create album image
-	apiKey, err := s.apiRepo.GetBy("user_id", userInfo.ID)
-	if err != nil {
+	// Albums are created with the user's photo account
+	if _, err := s.apiRepo.GetBy("user_id", userInfo.ID); err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusUnprocessableEntity,
 			Message: "get api key error",
 		})
 	}
 
+	for _, l := range param.Leads {
+		if _, err := s.bikipRepo.Get(l.Bikip.ID); err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Không tìm thấy bikip với ID: " + l.Bikip.ID,
+			})
+		}
+	}
+
 	space := regexp.MustCompile(`\s+`)
 	fullName := strings.Trim(param.FullName, " ,.")
 	// fullName = space.ReplaceAllString(fullName, " ")
@@ -322,13 +334,26 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 	// customerId := hash.MD5(strings.ToLower(fullName + lastCMND))
 	customerId := uuid.New().String()
 
-	existedCustomer, err := s.repo.GetByID(customerId)
-	if err == nil && existedCustomer != nil {
+	// A shared phone or CMND blocks the new customer, a similar name is only
+	// reported back to the agent.
+	duplicates, similar, err := s.findDuplicates(fullName, lastPhone, lastCMND, param.BirthYear)
+	if err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusBadRequest,
-			Message: "Khách hàng đã tồn tại!",
+			Message: "Invalid params",
+			Data:    err.Error(),
 		})
 	}
+	force, _ := strconv.ParseBool(c.QueryParam("force"))
+	if !force || !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		if len(duplicates) > 0 {
+			return c.JSON(http.StatusConflict, Response{
+				Code:    http.StatusConflict,
+				Message: "Khách hàng đã tồn tại!",
+				Data:    s.describeDuplicates(duplicates),
+			})
+		}
+	}
 
 	currentTime := time.Now()
 	currentTime = currentTime.Round(time.Second)
@@ -339,8 +364,6 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 		BirthYear: param.BirthYear,
 		City:      param.City,
 		Address:   param.Address,
-		LastCMND:  lastCMND,
-		Phone:     lastPhone,
 		Budget:    param.Budget,
 		Note:      note,
 
@@ -354,69 +377,38 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 
 		CreatedAt: currentTime,
 		UpdatedAt: currentTime,
+		Version:   1,
 	}
 
 	if len(param.Province) > 0 && userInfo.Group <= constant.GroupQTV {
 		candidate.Province = param.Province
 	}
 
-	// Set album id
-	albumId, err := s.createAlbum(apiKey.ID, "KH - "+fullName, fullName)
-	if err != nil {
+	if err := s.setIdentity(candidate, lastPhone, lastCMND); err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
-			Code:    http.StatusBadRequest,
-			Message: err.Error(),
+			Code:    http.StatusUnprocessableEntity,
+			Message: "Invalid params",
 		})
 	}
 
-	candidate.Album = albumId
+	// Albums are created in the background, the customer and its leads
+	// are stored pending until then.
+	candidate.AlbumStatus = AlbumStatusPending
 
 	leads := make([]*entity.CustomerLead, 0)
 	if param.Leads != nil && len(param.Leads) > 0 {
 		for _, l := range param.Leads {
 			lead := &entity.CustomerLead{
-				ID:        uuid.New().String(),
-				CID:       customerId,
-				UserID:    userInfo.ID,
-				BikipID:   l.Bikip.ID,
-				Comment:   l.Comment,
-				Images:    l.Images,
-				RegAt:     l.RegAt,
-				CreatedAt: currentTime,
-				UpdatedAt: currentTime,
-			}
-
-			var albumName = l.Bikip.Title
-			indexHD := strings.Index(strings.ToLower(albumName), "tỷ")
-			if indexHD > -1 {
-				albumName = albumName[:indexHD] + "tỷ"
-			}
-
-			if len(albumName) > 90 {
-				albumName = albumName[:90]
-			}
-			albumName = "LEAD - " + albumName
-			leadAlbumId, err := utils.CreateAlbum(apiKey.ID, albumName, l.Bikip.Title, candidate.Album)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-
-			var imgIds = make([]string, 0)
-			for idx, img := range lead.Images {
-				imgIds = append(imgIds, lead.Images[idx].GalleryID)
-				img.Album = leadAlbumId
-				img.Category = "7" // Category customer
-			}
-
-			if len(imgIds) > 0 {
-				_, err = s.editPhotoToAlbum(apiKey.ID, imgIds, leadAlbumId, "", "", false)
-				if err != nil {
-					return c.JSON(http.StatusBadRequest, Response{
-						Code:    http.StatusUnprocessableEntity,
-						Message: "lỗi upload ảnh: " + err.Error(),
-					})
-				}
+				ID:          uuid.New().String(),
+				CID:         customerId,
+				UserID:      userInfo.ID,
+				BikipID:     l.Bikip.ID,
+				Comment:     l.Comment,
+				Images:      l.Images,
+				RegAt:       l.RegAt,
+				AlbumStatus: AlbumStatusPending,
+				CreatedAt:   currentTime,
+				UpdatedAt:   currentTime,
 			}
 
 			leads = append(leads, lead)
@@ -425,7 +417,14 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 			}
 		}
 	}
+	candidate.LeadCount = len(leads)
+
+	// The customer is removed again if its leads cannot be stored, so the
+	// user never ends up with half a customer.
+	tx := newSaga("add customer " + customerId)
+	defer tx.rollback()
 
+	s.indexKeywords(candidate)
 	err = s.repo.Create(candidate)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
@@ -433,8 +432,19 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 			Message: "Invalid params",
 		})
 	}
+	tx.onRollback("customer", func() error {
+		return s.repo.Delete(candidate.ID)
+	})
 
 	if len(leads) > 0 {
+		tx.onRollback("leads", func() error {
+			for _, lead := range leads {
+				if err := s.repo.DeleteLead(lead.ID); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
 		err = s.repo.AddLead(leads)
 		if err != nil {
 			return c.JSON(http.StatusBadRequest, Response{
@@ -443,101 +453,27 @@ func (s *CustomerHandlerImpl) Add(c echo.Context) error {
 			})
 		}
 	}
+	tx.commit()
+
+	s.audit(userInfo, AuditCustomerCreate, candidate.ID, candidate.ID, nil, candidate)
+	for _, lead := range leads {
+		s.audit(userInfo, AuditLeadCreate, candidate.ID, lead.ID, nil, lead)
+	}
+	s.albumQueue.enqueue(candidate.ID)
 
+	var data interface{}
+	if len(similar) > 0 {
+		data = map[string]interface{}{
+			"similar": s.describeDuplicates(similar),
+		}
+	}
 	return c.JSON(http.StatusOK, Response{
 		Code:    http.StatusOK,
 		Message: "Success",
+		Data:    data,
 	})
 }
 
-func (h *CustomerHandlerImpl) editPhotoToAlbum(apiKey string, photoIds []string, albumId string, albumName string, albumDesc string, newAlbum bool) (string, error) {
-	h.httpClient.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
-	h.httpClient.SetTimeout(time.Second * 10)
-	data := map[string]string{
-		"key":                  apiKey,
-		"editing[album_id]":    albumId,
-		"editing[category_id]": "7", // 2 category tuan123
-		"edit":                 "image",
-	}
-
-	if newAlbum {
-		data["editing[album_name]"] = albumName
-		data["editing[album_privacy]"] = "password"
-		data["editing[album_description]"] = albumDesc
-		data["editing[album_password]"] = "6705a3bb63e4"
-		data["editing[new_album]"] = strconv.FormatBool(newAlbum)
-	}
-
-	imageIds := url.Values{
-		"editing[ids][]": photoIds,
-	}
-
-	resp, err := h.httpClient.R().
-		SetFormData(data).
-		SetFormDataFromValues(imageIds).
-		Post("https://api-dtk.thangbk.com/photos/edit")
-
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode() != 200 {
-		return "", errors.New(string(resp.Body()))
-	}
-
-	var res = make(map[string]interface{})
-	err = json.Unmarshal(resp.Body(), &res)
-	if err != nil {
-		return "", err
-	}
-
-	if newAlbum {
-		album := res["album"].(map[string]interface{})
-		newAlbumId := album["id_encoded"].(string)
-		return newAlbumId, nil
-	}
-
-	return albumId, nil
-}
-
-func (h *CustomerHandlerImpl) createAlbum(apiKey, name, desc string) (string, error) {
-
-	h.httpClient.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
-	h.httpClient.SetTimeout(time.Second * 10)
-	data := map[string]string{
-		"key":                apiKey,
-		"type":               "album",
-		"album[name]":        name,
-		"album[description]": desc,
-		"album[privacy]":     "password",
-		"album[password]":    "6705a3bb63e4",
-		"album[new]":         "true",
-	}
-
-	resp, err := h.httpClient.R().
-		SetFormData(data).
-		Post("https://album.daitheky.net/api/1/create-album")
-
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode() != 200 {
-		return "", errors.New("cannot create album")
-	}
-
-	var res = make(map[string]interface{})
-	err = json.Unmarshal(resp.Body(), &res)
-	if err != nil {
-		return "", err
-	}
-
-	album := res["album"].(map[string]interface{})
-	if albumId, ok := album["id_encoded"].(string); ok {
-		return albumId, nil
-	}
-
-	return "", nil
-}
-
 func (s *CustomerHandlerImpl) Info(c echo.Context) error {
 
 	// userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
@@ -548,15 +484,21 @@ func (s *CustomerHandlerImpl) Info(c echo.Context) error {
 	// 	})
 	// }
 
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
 	id := c.Param("id")
 	candidate, err := s.repo.GetByID(id)
-	if err != nil {
+	if err != nil || candidate.DeletedAt != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusBadRequest,
 			Message: "Không tìm thấy người dùng với ID: " + id,
 		})
 	}
 
+	if !policyFor(userInfo).CanView(candidate) {
+		return forbiddenCustomer(c)
+	}
+
 	user, _ := s.userRepo.GetByID(candidate.UserID)
 
 	candidate.User = user
@@ -595,6 +537,10 @@ func (s *CustomerHandlerImpl) Info(c echo.Context) error {
 		}
 	}
 
+	s.revealAlbumPasswords(candidate)
+	s.maskIdentity(candidate)
+
+	c.Response().Header().Set("ETag", customerETag(candidate))
 	return c.JSON(http.StatusOK, Response{
 		Code:    http.StatusOK,
 		Message: "Success",
@@ -606,8 +552,8 @@ func (s *CustomerHandlerImpl) UpdateStatus(c echo.Context) error {
 	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
 	id := c.Param("id")
 
-	var param entity.CustomerParam
-	err := c.Bind(&param)
+	var param UpdateStatusParam
+	err := s.bind(c, &param)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusBadRequest,
@@ -630,15 +576,42 @@ func (s *CustomerHandlerImpl) UpdateStatus(c echo.Context) error {
 	}
 
 	// existedCandidate.UserID = userId
-	if existedCustomer.UserID != userInfo.ID {
-		return c.JSON(http.StatusForbidden, Response{
-			Code:    http.StatusForbidden,
-			Message: "permission denied: you are not the owner of customer",
+	if existedCustomer.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanEdit(existedCustomer) {
+		return forbiddenCustomer(c)
+	}
+
+	if err := checkVersion(c, existedCustomer, param.Version); err != nil {
+		return conflictResponse(c, err)
+	}
+
+	if err := checkTransition(s.statusTransitions, existedCustomer.Status, param.Status); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
 		})
 	}
 
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	before := snapshot(existedCustomer)
+	existedCustomer.StatusHistory = append(existedCustomer.StatusHistory, &entity.CustomerStatusChange{
+		From:   existedCustomer.Status,
+		To:     param.Status,
+		Reason: strings.TrimSpace(param.Reason),
+		By:     userInfo.ID,
+		At:     currentTime,
+	})
 	existedCustomer.Status = param.Status
-	err = s.repo.Create(existedCustomer)
+	existedCustomer.UpdatedAt = currentTime
+	err = s.saveCustomer(existedCustomer)
+	if errors.Is(err, errVersionMismatch) {
+		return conflictResponse(c, err)
+	}
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusUnprocessableEntity,
@@ -646,6 +619,9 @@ func (s *CustomerHandlerImpl) UpdateStatus(c echo.Context) error {
 		})
 	}
 
+	s.audit(userInfo, AuditCustomerStatus, existedCustomer.ID, existedCustomer.ID, before, existedCustomer)
+
+	c.Response().Header().Set("ETag", customerETag(existedCustomer))
 	return c.JSON(http.StatusOK, Response{
 		Code:    http.StatusOK,
 		Message: "Success",
@@ -670,11 +646,28 @@ func (s *CustomerHandlerImpl) Update(c echo.Context) error {
 		return err
 	}
 
-	if existedCustomer.UserID != userInfo.ID {
-		return c.JSON(http.StatusForbidden, Response{
-			Code:    http.StatusForbidden,
-			Message: "permission denied: you are not the owner of customer",
-		})
+	if existedCustomer.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanEdit(existedCustomer) {
+		return forbiddenCustomer(c)
+	}
+
+	if err := checkVersion(c, existedCustomer, param.Version); err != nil {
+		return conflictResponse(c, err)
+	}
+
+	for _, l := range param.Leads {
+		if len(l.ID) != 0 {
+			continue
+		}
+		if _, err := s.bikipRepo.Get(l.BikipID); err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Không tìm thấy bikip với ID: " + l.BikipID,
+			})
+		}
 	}
 
 	space := regexp.MustCompile(`\s+`)
@@ -690,15 +683,32 @@ func (s *CustomerHandlerImpl) Update(c echo.Context) error {
 	currentTime := time.Now()
 	currentTime = currentTime.Round(time.Second)
 
+	before := snapshot(existedCustomer)
 	existedCustomer.BirthYear = param.BirthYear
 	existedCustomer.City = param.City
-	existedCustomer.LastCMND = lastCMND
-	existedCustomer.Phone = lastPhone
+	// Clients only ever see the masked phone and CMND, sending them back
+	// or leaving them out keeps the stored values. Only re-encrypt on
+	// change, a new nonce would mark an unchanged value as modified. Plain
+	// text records are encrypted on their first update.
+	phone, cmnd := s.identity(existedCustomer)
+	lastPhone = keptIdentity(lastPhone, phone)
+	lastCMND = keptIdentity(lastCMND, cmnd)
+	if phone != lastPhone || cmnd != lastCMND || !identitySealed(existedCustomer) {
+		if err := s.setIdentity(existedCustomer, lastPhone, lastCMND); err != nil {
+			return c.JSON(http.StatusUnprocessableEntity, Response{
+				Code:    http.StatusUnprocessableEntity,
+				Message: "Invalid params",
+			})
+		}
+	}
 	existedCustomer.Budget = param.Budget
 	existedCustomer.Districts = param.Districts
 	existedCustomer.UpdatedAt = currentTime
 
-	err = s.repo.Create(existedCustomer)
+	err = s.saveCustomer(existedCustomer)
+	if errors.Is(err, errVersionMismatch) {
+		return conflictResponse(c, err)
+	}
 	if err != nil {
 		return c.JSON(http.StatusUnprocessableEntity, Response{
 			Code:    http.StatusUnprocessableEntity,
@@ -706,6 +716,8 @@ func (s *CustomerHandlerImpl) Update(c echo.Context) error {
 		})
 	}
 
+	s.audit(userInfo, AuditCustomerUpdate, existedCustomer.ID, existedCustomer.ID, before, existedCustomer)
+
 	// leads := existedCustomer.Leads
 	// if leads == nil {
 	// 	leads = make([]*entity.CustomerLead, 0)
@@ -720,14 +732,15 @@ func (s *CustomerHandlerImpl) Update(c echo.Context) error {
 			}
 
 			lead := &entity.CustomerLead{
-				ID:        uuid.New().String(),
-				CID:       existedCustomer.ID,
-				UserID:    userInfo.ID,
-				BikipID:   l.BikipID,
-				Comment:   l.Comment,
-				Images:    l.Images,
-				RegAt:     l.RegAt,
-				CreatedAt: currentTime,
+				ID:          uuid.New().String(),
+				CID:         existedCustomer.ID,
+				UserID:      userInfo.ID,
+				BikipID:     l.BikipID,
+				Comment:     l.Comment,
+				Images:      l.Images,
+				RegAt:       l.RegAt,
+				AlbumStatus: AlbumStatusPending,
+				CreatedAt:   currentTime,
 			}
 
 			leads = append(leads, lead)
@@ -742,6 +755,25 @@ func (s *CustomerHandlerImpl) Update(c echo.Context) error {
 		})
 	}
 
+	for _, lead := range leads {
+		s.audit(userInfo, AuditLeadCreate, existedCustomer.ID, lead.ID, nil, lead)
+	}
+
+	// Their albums are created in the background, as for Lead.
+	if len(leads) > 0 {
+		err = s.updateCustomer(existedCustomer, func(cus *entity.Customer) {
+			leadsAdded(cus, leads)
+		})
+		s.albumQueue.enqueue(existedCustomer.ID)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, Response{
+				Code:    http.StatusInternalServerError,
+				Message: "Cập nhật thông tin không thành công",
+			})
+		}
+	}
+
+	c.Response().Header().Set("ETag", customerETag(existedCustomer))
 	return c.JSON(http.StatusOK, Response{
 		Code:    http.StatusOK,
 		Message: "Success",
@@ -766,11 +798,12 @@ func (s *CustomerHandlerImpl) Lead(c echo.Context) error {
 		})
 	}
 
-	if candidate.UserID != userInfo.ID {
-		return c.JSON(http.StatusForbidden, Response{
-			Code:    http.StatusForbidden,
-			Message: "permission denied: you are not the owner of customer",
-		})
+	if candidate.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanEdit(candidate) {
+		return forbiddenCustomer(c)
 	}
 
 	var params = make([]*entity.CustomerLeadParam, 0)
@@ -782,8 +815,8 @@ func (s *CustomerHandlerImpl) Lead(c echo.Context) error {
 		})
 	}
 
-	apiKey, err := s.apiRepo.GetBy("user_id", userInfo.ID)
-	if err != nil {
+	// Lead albums live on the owner's photo account, whoever adds the lead.
+	if _, err := s.apiRepo.GetBy("user_id", candidate.UserID); err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusBadRequest,
 			Message: "Invalid params",
@@ -791,80 +824,66 @@ func (s *CustomerHandlerImpl) Lead(c echo.Context) error {
 		})
 	}
 
+	for _, p := range params {
+		if _, err := s.bikipRepo.Get(p.BikipID); err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Không tìm thấy bikip với ID: " + p.BikipID,
+			})
+		}
+	}
+
 	currentTime := time.Now()
 	leads := make([]*entity.CustomerLead, 0)
 	for _, p := range params {
 		lead := &entity.CustomerLead{
-			ID:        uuid.New().String(),
-			CID:       id,
-			BikipID:   p.BikipID,
-			UserID:    userInfo.ID,
-			RegAt:     p.RegAt,
-			Comment:   p.Comment,
-			CreatedAt: currentTime,
-		}
-
-		bikip, err := s.bikipRepo.Get(p.BikipID)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		var albumName = bikip.Title
-		indexHD := strings.Index(strings.ToLower(albumName), "tỷ")
-		if indexHD > -1 {
-			albumName = albumName[:indexHD] + "tỷ"
-		}
-
-		if len(albumName) > 90 {
-			albumName = albumName[:90]
-		}
-
-		albumName = "LEAD - " + albumName
-		albumId, err := utils.CreateAlbum(apiKey.ID, albumName, bikip.Title, candidate.Album)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		if p.Images != nil && len(p.Images) > 0 {
-			for _, img := range p.Images {
-				img.Album = albumId
-			}
+			ID:          uuid.New().String(),
+			CID:         id,
+			BikipID:     p.BikipID,
+			UserID:      userInfo.ID,
+			RegAt:       p.RegAt,
+			Comment:     p.Comment,
+			Images:      p.Images,
+			AlbumStatus: AlbumStatusPending,
+			CreatedAt:   currentTime,
 		}
 
-		lead.Images = p.Images
 		leads = append(leads, lead)
-		if candidate.LeadAt == nil || candidate.LeadAt.Unix() < lead.RegAt.Unix() {
-			candidate.LeadAt = &lead.RegAt
-		}
 	}
 
-	err = s.repo.Create(candidate)
+	err = s.repo.AddLead(leads)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusBadRequest,
-			Message: "Lỗi cập nhật thông tin ID: " + id,
+			Message: "Add lead error",
+			Data:    err.Error(),
 		})
 	}
-	if len(leads) > 0 {
-		err = s.repo.AddLead(leads)
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, Response{
-				Code:    http.StatusBadRequest,
-				Message: "Add lead error",
-				Data:    err.Error(),
-			})
-		}
+	for _, lead := range leads {
+		s.audit(userInfo, AuditLeadCreate, candidate.ID, lead.ID, nil, lead)
 	}
 
-	return c.JSON(http.StatusOK, Response{
-		Code:    http.StatusOK,
-		Message: "Success",
+	// Lead albums are created in the background. The customer is marked
+	// pending after its leads are stored, a job running meanwhile would
+	// otherwise clear the mark before seeing them.
+	err = s.updateCustomer(candidate, func(cus *entity.Customer) {
+		leadsAdded(cus, leads)
 	})
-}
-
-func (s *CustomerHandlerImpl) ListLead(c echo.Context) error {
+	s.albumQueue.enqueue(candidate.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Lỗi cập nhật thông tin ID: " + id,
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+	})
+}
+
+func (s *CustomerHandlerImpl) ListLead(c echo.Context) error {
 	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
 	if userInfo.Group >= constant.GroupChuyenGia {
 		return c.JSON(http.StatusBadRequest, Response{
@@ -882,11 +901,12 @@ func (s *CustomerHandlerImpl) ListLead(c echo.Context) error {
 		})
 	}
 
-	if candidate.UserID != userInfo.ID {
-		return c.JSON(http.StatusForbidden, Response{
-			Code:    http.StatusForbidden,
-			Message: "permission denied: you are not the owner of customer",
-		})
+	if candidate.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanView(candidate) {
+		return forbiddenCustomer(c)
 	}
 
 	var request QueryCustomer
@@ -897,7 +917,16 @@ func (s *CustomerHandlerImpl) ListLead(c echo.Context) error {
 		})
 	}
 
-	leads, count, err := s.repo.ListLead(id, request.Offset, request.Limit)
+	limit := pageLimit(request.Limit)
+
+	var after []interface{}
+	if len(request.Cursor) > 0 {
+		if after, err = decodeCursor(request.Cursor, leadSort); err != nil {
+			return listError(c, err)
+		}
+	}
+
+	leads, count, last, err := s.repo.ListLeadPage(id, after, request.Offset, limit)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, Response{
 			Code:    http.StatusBadRequest,
@@ -905,33 +934,516 @@ func (s *CustomerHandlerImpl) ListLead(c echo.Context) error {
 		})
 	}
 
+	next := ""
+	if len(leads) == limit {
+		next = encodeCursor(leadSort, last...)
+	}
+
 	return c.JSON(http.StatusOK, Response{
 		Code:    http.StatusOK,
 		Message: "Success",
 		Data: map[string]interface{}{
-			"items": leads,
-			"total": count,
+			"items":       leads,
+			"total":       count,
+			"next_cursor": next,
 		},
 	})
 }
 
 func (s *CustomerHandlerImpl) UpdateLead(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
+	id := c.Param("id")
+	leadId := c.Param("leadId")
+	candidate, err := s.repo.GetByID(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+
+	if candidate.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanEdit(candidate) {
+		return forbiddenCustomer(c)
+	}
+
+	var param entity.CustomerLeadParam
+	if err := (&echo.DefaultBinder{}).BindBody(c, &param); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+
+	defer s.leadLocks.lock(id)()
+
+	lead, err := s.repo.GetLead(leadId)
+	if err != nil || lead.CID != id {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy lead với ID: " + leadId,
+		})
+	}
+
+	apiKey, err := s.apiRepo.GetBy("user_id", candidate.UserID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "get api key error",
+		})
+	}
+
+	if len(param.BikipID) == 0 {
+		param.BikipID = lead.BikipID
+	}
+	bikip, err := s.bikipRepo.Get(param.BikipID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy bikip với ID: " + param.BikipID,
+		})
+	}
+
+	before := snapshot(lead)
+
+	images := param.Images
+	if images == nil {
+		images = lead.Images
+	}
+
+	// A pending or failed lead gets its album from the background job,
+	// which picks up the new bikip and photos.
+	pending := needsAlbum(lead.AlbumStatus) || len(candidate.Album) == 0
+
+	regChanged := !param.RegAt.IsZero() && !param.RegAt.Equal(lead.RegAt)
+
+	// A new bikip or registration date renames the lead album, the name
+	// template may use either. A lead without album gets a fresh one. New
+	// photos are moved into it below.
+	albumId := leadAlbumOf(lead)
+	if pending {
+		lead.AlbumStatus = AlbumStatusPending
+	} else if param.BikipID != lead.BikipID || regChanged || len(albumId) == 0 {
+		regAt := lead.RegAt
+		if !param.RegAt.IsZero() {
+			regAt = param.RegAt
+		}
+
+		name := s.albumName.lead(bikip.Title, regAt)
+		if len(albumId) > 0 {
+			err = s.albums.RenameAlbum(apiKey.ID, albumId, name, bikip.Title)
+		} else {
+			albumId, lead.AlbumPassword, err = s.createAlbum(apiKey.ID, name, bikip.Title, candidate.Album)
+			lead.AlbumStatus = ""
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusUnprocessableEntity,
+				Message: "lỗi cập nhật album: " + err.Error(),
+			})
+		}
+	}
+
+	var imgIds = make([]string, 0)
+	if !pending {
+		for _, img := range images {
+			if img.Album != albumId {
+				imgIds = append(imgIds, img.GalleryID)
+			}
+			img.Album = albumId
+			img.Category = "7" // Category customer
+		}
+	}
+
+	if len(imgIds) > 0 {
+		err = s.albums.MoveImages(apiKey.ID, imgIds, albumId)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusUnprocessableEntity,
+				Message: "lỗi upload ảnh: " + err.Error(),
+			})
+		}
+	}
+
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	lead.BikipID = param.BikipID
+	if len(param.Comment) > 0 {
+		lead.Comment = param.Comment
+	}
+	lead.Images = images
+	if !param.RegAt.IsZero() {
+		lead.RegAt = param.RegAt
+	}
+	lead.UpdatedAt = currentTime
+
+	err = s.repo.AddLead([]*entity.CustomerLead{lead})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Update lead error",
+			Data:    err.Error(),
+		})
+	}
+
+	s.audit(userInfo, AuditLeadUpdate, candidate.ID, lead.ID, before, lead)
+
+	// As in Lead, the customer is marked pending after the lead is stored.
+	if pending {
+		err = s.updateCustomer(candidate, func(cus *entity.Customer) {
+			cus.AlbumStatus = AlbumStatusPending
+		})
+		s.albumQueue.enqueue(candidate.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Lỗi cập nhật thông tin ID: " + id,
+			})
+		}
+	}
+
+	if regChanged {
+		leads, err := s.allLeads(id)
+		if err == nil {
+			for i := range leads {
+				if leads[i].ID == lead.ID {
+					leads[i] = lead
+				}
+			}
+			err = s.updateCustomer(candidate, func(cus *entity.Customer) {
+				cus.LeadAt = latestLeadAt(leads)
+				cus.UpdatedAt = currentTime
+			})
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Lỗi cập nhật thông tin ID: " + id,
+			})
+		}
+	}
+
 	return c.JSON(http.StatusOK, Response{
 		Code:    http.StatusOK,
 		Message: "Success",
+		Data:    lead,
 	})
 }
 
+// leadsAdded records new leads on their customer and marks it pending, their
+// albums are created by the album job.
+func leadsAdded(cus *entity.Customer, leads []*entity.CustomerLead) {
+	for _, lead := range leads {
+		if cus.LeadAt == nil || cus.LeadAt.Unix() < lead.RegAt.Unix() {
+			regAt := lead.RegAt
+			cus.LeadAt = &regAt
+		}
+	}
+	cus.LeadCount += len(leads)
+	cus.AlbumStatus = AlbumStatusPending
+}
+
+// allLeads pages through every lead of a customer.
+func (s *CustomerHandlerImpl) allLeads(cid string) ([]*entity.CustomerLead, error) {
+	const pageSize = 100
+
+	leads := make([]*entity.CustomerLead, 0)
+	for offset := 0; ; offset += pageSize {
+		items, total, err := s.repo.ListLead(cid, offset, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		leads = append(leads, items...)
+		if len(items) < pageSize || int64(len(leads)) >= int64(total) {
+			return leads, nil
+		}
+	}
+}
+
+// latestLeadAt returns the most recent RegAt of leads, nil when there is none.
+func latestLeadAt(leads []*entity.CustomerLead) *time.Time {
+	var leadAt *time.Time
+	for _, l := range leads {
+		if leadAt == nil || leadAt.Unix() < l.RegAt.Unix() {
+			regAt := l.RegAt
+			leadAt = &regAt
+		}
+	}
+	return leadAt
+}
+
+// leadAlbumOf returns the album holding the photos of a lead.
+func leadAlbumOf(lead *entity.CustomerLead) string {
+	for _, img := range lead.Images {
+		if len(img.Album) > 0 {
+			return img.Album
+		}
+	}
+	return ""
+}
+
 func (s *CustomerHandlerImpl) DeleteLead(c echo.Context) error {
-	return c.JSON(http.StatusBadRequest, Response{
-		Code:    http.StatusBadRequest,
-		Message: "Permission denied",
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
+	id := c.Param("id")
+	leadId := c.Param("leadId")
+	candidate, err := s.repo.GetByID(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+
+	if candidate.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanEdit(candidate) {
+		return forbiddenCustomer(c)
+	}
+
+	defer s.leadLocks.lock(id)()
+
+	leads, err := s.allLeads(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+
+	var lead *entity.CustomerLead
+	remaining := make([]*entity.CustomerLead, 0, len(leads))
+	for _, l := range leads {
+		if l.ID == leadId {
+			lead = l
+			continue
+		}
+		remaining = append(remaining, l)
+	}
+	if lead == nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy lead với ID: " + leadId,
+		})
+	}
+
+	err = s.repo.DeleteLead(lead.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Delete lead error",
+			Data:    err.Error(),
+		})
+	}
+
+	s.audit(userInfo, AuditLeadDelete, candidate.ID, lead.ID, snapshot(lead), nil)
+
+	// The lead is gone, an album left behind only costs space and is
+	// reported by the album reconciliation.
+	if albumId := leadAlbumOf(lead); len(albumId) > 0 {
+		apiKey, err := s.apiRepo.GetBy("user_id", candidate.UserID)
+		if err == nil {
+			err = s.albums.DeleteAlbum(apiKey.ID, albumId)
+		}
+		if err != nil {
+			log.Println("delete lead album", lead.ID, albumId, err)
+		}
+	}
+
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	err = s.updateCustomer(candidate, func(cus *entity.Customer) {
+		cus.LeadAt = latestLeadAt(remaining)
+		cus.LeadCount = len(remaining)
+		cus.UpdatedAt = currentTime
+	})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Lỗi cập nhật thông tin ID: " + id,
+		})
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
 	})
 }
 
 func (s *CustomerHandlerImpl) Delete(c echo.Context) error {
-	return c.JSON(http.StatusBadRequest, Response{
-		Code:    http.StatusBadRequest,
-		Message: "Permission denied",
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
+	id := c.Param("id")
+	existedCustomer, err := s.repo.GetByID(id)
+	if err != nil || existedCustomer.DeletedAt != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+
+	if existedCustomer.UserID != userInfo.ID && !policyFor(userInfo).IsAdmin() {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "permission denied: you are not the owner of customer",
+		})
+	}
+
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	before := snapshot(existedCustomer)
+	existedCustomer.DeletedAt = &currentTime
+	existedCustomer.DeletedBy = userInfo.ID
+	existedCustomer.UpdatedAt = currentTime
+
+	err = s.saveCustomer(existedCustomer)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, Response{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "Xoá khách hàng không thành công",
+		})
+	}
+
+	s.audit(userInfo, AuditCustomerDelete, existedCustomer.ID, existedCustomer.ID, before, existedCustomer)
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+	})
+}
+
+// deletedCustomer answers requests on a customer in the trash, which only
+// Restore may change.
+func deletedCustomer(c echo.Context, id string) error {
+	return c.JSON(http.StatusGone, Response{
+		Code:    http.StatusGone,
+		Message: "Khách hàng đã bị xoá, ID: " + id,
+	})
+}
+
+func (s *CustomerHandlerImpl) Restore(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	id := c.Param("id")
+	existedCustomer, err := s.repo.GetByID(id)
+	if err != nil || existedCustomer.DeletedAt == nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy khách hàng đã xoá với ID: " + id,
+		})
+	}
+
+	// A merged customer lives on in the survivor, restoring it would only
+	// bring back an empty duplicate.
+	if len(existedCustomer.MergedInto) > 0 {
+		return c.JSON(http.StatusConflict, Response{
+			Code:    http.StatusConflict,
+			Message: "Khách hàng đã được gộp vào ID: " + existedCustomer.MergedInto,
+		})
+	}
+
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	before := snapshot(existedCustomer)
+	existedCustomer.DeletedAt = nil
+	existedCustomer.DeletedBy = ""
+	existedCustomer.UpdatedAt = currentTime
+
+	err = s.saveCustomer(existedCustomer)
+	if err != nil {
+		return c.JSON(http.StatusUnprocessableEntity, Response{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "Khôi phục khách hàng không thành công",
+		})
+	}
+
+	s.audit(userInfo, AuditCustomerRestore, existedCustomer.ID, existedCustomer.ID, before, existedCustomer)
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+	})
+}
+
+// Trash lists the soft deleted customers, most recently deleted first.
+func (s *CustomerHandlerImpl) Trash(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	var request QueryCustomer
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+		})
+	}
+
+	sortField, err := parseSort(request.Sort, "-deleted_at")
+	if err != nil {
+		return invalidSort(c, err)
+	}
+
+	query := And(s.customerFilter(&request), policyFor(userInfo).Scope(), Exists("deleted_at"))
+
+	count, err := s.repo.Count(query)
+	if err != nil {
+		return c.JSON(http.StatusOK, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Not found",
+			Data:    err.Error(),
+		})
+	}
+
+	if count == 0 {
+		return c.JSON(http.StatusOK, Response{
+			Code:    http.StatusOK,
+			Message: "Success",
+			Data: map[string]interface{}{
+				"items": []entity.Customer{},
+				"total": 0,
+			},
+		})
+	}
+
+	customers, next, err := s.listCustomers(query, sortField, request.Cursor, request.Offset, request.Limit)
+	if err != nil {
+		return listError(c, err)
+	}
+	for _, cus := range customers {
+		hideAlbumPasswords(cus)
+		s.maskIdentity(cus)
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data: map[string]interface{}{
+			"items":       customers,
+			"total":       count,
+			"next_cursor": next,
+		},
 	})
 }
@@ -0,0 +1,483 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestAddProvisionsAlbums(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+
+	res := h.call(t, h.Add, user, http.MethodPost, `{
+		"full_name": "Nguyễn Văn An", "phone": "0901 234 589", "last_cmnd": "079123456789",
+		"leads": [{"bikip": {"id": "b1"}, "comment": "xem nhà",
+			"images": [{"gallery_id": "img1"}, {"gallery_id": "img2"}],
+			"reg_at": "2024-05-01T10:00:00Z"}]}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Add = %d %s", res.Status, res.Message)
+	}
+
+	cus := h.waitAlbums(t, h.onlyCustomer(t).ID)
+	if cus.AlbumStatus != "" {
+		t.Fatalf("album status = %q", cus.AlbumStatus)
+	}
+	album := h.photos.Album(cus.Album)
+	if album == nil || album.Owner != "key-agent" {
+		t.Fatalf("customer album = %+v, want one owned by key-agent", album)
+	}
+	if cus.Phone == "0901 234 589" || cus.LastCMND == "079123456789" {
+		t.Error("identity stored in plain text")
+	}
+
+	leads := h.customers.customerLeads(cus.ID)
+	if len(leads) != 1 || leads[0].AlbumStatus != "" {
+		t.Fatalf("leads = %+v", leads)
+	}
+	leadAlbum := h.photos.Album(leadAlbumOf(leads[0]))
+	if leadAlbum == nil || leadAlbum.Parent != cus.Album || len(leadAlbum.Images) != 2 {
+		t.Fatalf("lead album = %+v, want the 2 photos under the customer album", leadAlbum)
+	}
+	if leadAlbum.Desc != "Căn hộ Quận 1 giá 5 tỷ" {
+		t.Errorf("lead album description = %q", leadAlbum.Desc)
+	}
+}
+
+func TestAddRejectsDuplicates(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+
+	res := h.call(t, h.Add, user, http.MethodPost, `{"full_name": "Nguyễn Văn An", "phone": "0901234589", "last_cmnd": "079123456789"}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Add = %d %s", res.Status, res.Message)
+	}
+	first := h.waitAlbums(t, h.onlyCustomer(t).ID)
+
+	tests := []struct {
+		name, body string
+	}{
+		{"same phone", `{"full_name": "Trần Thị Bình", "phone": "+84 901 234 589"}`},
+		{"same cmnd", `{"full_name": "Trần Thị Bình", "last_cmnd": "079 123 456 789"}`},
+	}
+	for _, tt := range tests {
+		res := h.call(t, h.Add, agent("agent2", "sales"), http.MethodPost, tt.body)
+		if res.Status != http.StatusConflict {
+			t.Errorf("%s: Add = %d, want %d", tt.name, res.Status, http.StatusConflict)
+		}
+	}
+
+	// A similar name alone may be another person, the agent is only warned.
+	res = h.call(t, h.Add, agent("agent2", "sales"), http.MethodPost, `{"full_name": "Nguyen Van Anh", "birth_year": 1990}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("similar name: Add = %d %s", res.Status, res.Message)
+	}
+	var data struct {
+		Similar []struct {
+			ID string `json:"id"`
+		} `json:"similar"`
+	}
+	if err := json.Unmarshal(res.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Similar) != 1 || data.Similar[0].ID != first.ID {
+		t.Errorf("similar = %+v, want %s", data.Similar, first.ID)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+
+	tests := []struct {
+		name string
+		user string
+		dept string
+		perm []string
+		want int
+	}{
+		{"owner", "agent", "sales", nil, http.StatusOK},
+		{"colleague", "agent2", "sales", nil, http.StatusForbidden},
+		{"manager", "boss", "sales", []string{"member.view"}, http.StatusOK},
+		{"other manager", "boss2", "rentals", []string{"member.view"}, http.StatusForbidden},
+		{"admin", "root", "hq", []string{"admin.member.view"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		res := h.call(t, h.Info, agent(tt.user, tt.dept, tt.perm...), http.MethodGet, "", "id", "c1")
+		if res.Status != tt.want {
+			t.Errorf("%s: Info = %d, want %d", tt.name, res.Status, tt.want)
+		}
+	}
+}
+
+func TestUpdateLeadRenamesAlbum(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	cus := h.seed(t, "c1", "agent", "sales")
+	lead := h.seedLead(t, cus, "l1", "b1", "img1")
+	albumId := leadAlbumOf(lead)
+
+	res := h.call(t, h.UpdateLead, user, http.MethodPut, `{"bikip_id": "b2"}`, "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UpdateLead = %d %s", res.Status, res.Message)
+	}
+
+	album := h.photos.Album(albumId)
+	if album == nil || album.Desc != "Nhà phố Quận 3 giá 9 tỷ" || len(album.Images) != 1 {
+		t.Fatalf("lead album = %+v, want it renamed after b2 with its photo", album)
+	}
+	if n := h.photos.Len(); n != 2 {
+		t.Errorf("%d albums, want the customer and lead albums only", n)
+	}
+
+	updated, _ := h.customers.GetLead("l1")
+	if updated.BikipID != "b2" || updated.Comment != "first visit" {
+		t.Errorf("lead = %+v, want bikip b2 and the comment kept", updated)
+	}
+}
+
+func TestUpdateLeadOfAnotherCustomer(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+	other := h.seed(t, "c2", "agent", "sales")
+	h.seedLead(t, other, "l2", "b1")
+
+	res := h.call(t, h.UpdateLead, user, http.MethodPut, `{"comment": "x"}`, "id", "c1", "leadId", "l2")
+	if res.Status != http.StatusBadRequest {
+		t.Fatalf("UpdateLead = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+}
+
+func TestDeleteLead(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	cus := h.seed(t, "c1", "agent", "sales")
+	lead := h.seedLead(t, cus, "l1", "b1", "img1")
+
+	h.customers.failDeleteLead = errors.New("index unavailable")
+	res := h.call(t, h.DeleteLead, user, http.MethodDelete, "", "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusBadRequest {
+		t.Fatalf("DeleteLead = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+	if h.photos.Album(leadAlbumOf(lead)) == nil {
+		t.Fatal("album deleted although the lead was kept")
+	}
+
+	h.customers.failDeleteLead = nil
+	res = h.call(t, h.DeleteLead, user, http.MethodDelete, "", "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("DeleteLead = %d %s", res.Status, res.Message)
+	}
+	if h.photos.Album(leadAlbumOf(lead)) != nil {
+		t.Error("lead album left behind")
+	}
+	if _, err := h.customers.GetLead("l1"); err == nil {
+		t.Error("lead still stored")
+	}
+}
+
+func TestDeletedCustomerIsGone(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.Delete, user, http.MethodDelete, "", "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Delete = %d %s", res.Status, res.Message)
+	}
+
+	res = h.call(t, h.Lead, user, http.MethodPost, `{"bikip": {"id": "b1"}}`, "id", "c1")
+	if res.Status != http.StatusGone {
+		t.Errorf("Lead on a deleted customer = %d, want %d", res.Status, http.StatusGone)
+	}
+	res = h.call(t, h.Update, user, http.MethodPut, `{"full_name": "X"}`, "id", "c1")
+	if res.Status != http.StatusGone {
+		t.Errorf("Update on a deleted customer = %d, want %d", res.Status, http.StatusGone)
+	}
+
+	res = h.call(t, h.Restore, agent("root", "hq", "admin.member.view"), http.MethodPost, "", "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Restore = %d %s", res.Status, res.Message)
+	}
+	if cus, _ := h.customers.GetByID("c1"); cus.DeletedAt != nil {
+		t.Error("customer still deleted")
+	}
+}
+
+func TestMergeMovesLeads(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	survivor := h.seed(t, "c1", "agent", "sales")
+	loser := h.seed(t, "c2", "agent", "sales")
+	lead := h.seedLead(t, loser, "l2", "b1", "img1", "img2")
+	oldAlbum := leadAlbumOf(lead)
+
+	res := h.call(t, h.Merge, user, http.MethodPost, `{"sources": ["c2"]}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Merge = %d %s", res.Status, res.Message)
+	}
+
+	moved, _ := h.customers.GetLead("l2")
+	if moved.CID != "c1" {
+		t.Fatalf("lead belongs to %s, want c1", moved.CID)
+	}
+	album := h.photos.Album(leadAlbumOf(moved))
+	if album == nil || album.Parent != survivor.Album || len(album.Images) != 2 {
+		t.Fatalf("lead album = %+v, want the photos under the survivor album", album)
+	}
+	if h.photos.Album(oldAlbum) != nil {
+		t.Error("emptied album left behind")
+	}
+	if merged, _ := h.customers.GetByID("c2"); merged.DeletedAt == nil || merged.MergedInto != "c1" {
+		t.Errorf("merged customer = %+v", merged)
+	}
+}
+
+func TestMergeRollsBack(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+	loser := h.seed(t, "c2", "agent", "sales")
+	lead := h.seedLead(t, loser, "l2", "b1", "img1")
+	oldAlbum := leadAlbumOf(lead)
+	albums := h.photos.Len()
+
+	h.customers.failAddLead = errors.New("index unavailable")
+	res := h.call(t, h.Merge, user, http.MethodPost, `{"sources": ["c2"]}`, "id", "c1")
+	if res.Status == http.StatusOK {
+		t.Fatal("Merge succeeded although the leads could not be stored")
+	}
+
+	if n := h.photos.Len(); n != albums {
+		t.Errorf("%d albums after the rollback, want %d", n, albums)
+	}
+	if album := h.photos.Album(oldAlbum); album == nil || len(album.Images) != 1 {
+		t.Errorf("old lead album = %+v, want the photo moved back", album)
+	}
+	if cus, _ := h.customers.GetByID("c2"); cus.DeletedAt != nil {
+		t.Error("loser deleted by a failed merge")
+	}
+}
+
+func TestTransferMovesAlbums(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	lead := h.seedLead(t, cus, "l1", "b1", "img1")
+
+	boss := agent("boss", "sales", "member.view")
+	res := h.call(t, h.Transfer, boss, http.MethodPost, `{"ids": ["c1"], "to_user": "agent2"}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Transfer = %d %s", res.Status, res.Message)
+	}
+
+	for _, albumId := range []string{cus.Album, leadAlbumOf(lead)} {
+		if album := h.photos.Album(albumId); album.Owner != "key-agent2" {
+			t.Errorf("album %s owned by %s, want key-agent2", albumId, album.Owner)
+		}
+	}
+	if moved, _ := h.customers.GetByID("c1"); moved.UserID != "agent2" {
+		t.Errorf("customer owned by %s, want agent2", moved.UserID)
+	}
+	if kept, _ := h.customers.GetLead("l1"); kept.UserID != "agent" {
+		t.Errorf("lead registered by %s, want agent", kept.UserID)
+	}
+
+	res = h.call(t, h.Transfer, boss, http.MethodPost, `{"ids": ["c1"], "to_user": "other", "to_dept": "sales"}`)
+	if res.Status != http.StatusBadRequest {
+		t.Errorf("Transfer to a user outside to_dept = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.UpdateStatus, user, http.MethodPut, `{"status": 5, "reason": "ký hợp đồng"}`, "id", "c1")
+	if res.Status != http.StatusBadRequest {
+		t.Errorf("skipping to closed = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+
+	res = h.call(t, h.UpdateStatus, user, http.MethodPut, `{"status": 1, "reason": "đã gọi"}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UpdateStatus = %d %s", res.Status, res.Message)
+	}
+	cus, _ := h.customers.GetByID("c1")
+	if cus.Status != StatusContacted || len(cus.StatusHistory) != 1 {
+		t.Errorf("customer = status %d, %d changes", cus.Status, len(cus.StatusHistory))
+	}
+}
+
+func TestLeadRejectsUnknownBikip(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.Lead, user, http.MethodPost, `[
+		{"bikip_id": "b1", "reg_at": "2024-05-01T10:00:00Z"},
+		{"bikip_id": "nope", "reg_at": "2024-05-02T10:00:00Z"}]`, "id", "c1")
+	if res.Status != http.StatusBadRequest || res.Message != "Không tìm thấy bikip với ID: nope" {
+		t.Fatalf("Lead = %d %q, want the unknown bikip named", res.Status, res.Message)
+	}
+	if leads := h.customers.customerLeads("c1"); len(leads) != 0 {
+		t.Errorf("%d leads stored, want none", len(leads))
+	}
+
+	res = h.call(t, h.Lead, user, http.MethodPost, `[{"bikip_id": "b1", "images": [{"gallery_id": "img1"}],
+		"reg_at": "2024-05-01T10:00:00Z"}]`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Lead = %d %s", res.Status, res.Message)
+	}
+	h.waitAlbums(t, "c1")
+	leads := h.customers.customerLeads("c1")
+	if len(leads) != 1 || h.photos.Album(leadAlbumOf(leads[0])) == nil {
+		t.Errorf("leads = %+v, want one with its album", leads)
+	}
+}
+
+func TestLeadCount(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+
+	res := h.call(t, h.Add, user, http.MethodPost, `{"full_name": "Nguyễn Văn An",
+		"leads": [{"bikip": {"id": "b1"}, "reg_at": "2024-05-01T10:00:00Z"}]}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Add = %d %s", res.Status, res.Message)
+	}
+	id := h.waitAlbums(t, h.onlyCustomer(t).ID).ID
+
+	count := func(id string) int {
+		t.Helper()
+		cus, err := h.customers.GetByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cus.LeadCount
+	}
+	if n := count(id); n != 1 {
+		t.Fatalf("lead count after Add = %d, want 1", n)
+	}
+
+	res = h.call(t, h.Lead, user, http.MethodPost, `[{"bikip_id": "b1"}, {"bikip_id": "b2"}]`, "id", id)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Lead = %d %s", res.Status, res.Message)
+	}
+	h.waitAlbums(t, id)
+	if n := count(id); n != 3 {
+		t.Fatalf("lead count after Lead = %d, want 3", n)
+	}
+
+	res = h.call(t, h.Update, user, http.MethodPut, `{"full_name": "Nguyễn Văn An", "leads": [{"bikip_id": "b2"}]}`, "id", id)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Update = %d %s", res.Status, res.Message)
+	}
+	h.waitAlbums(t, id)
+	if n := count(id); n != 4 {
+		t.Fatalf("lead count after Update = %d, want 4", n)
+	}
+
+	lead := h.customers.customerLeads(id)[0]
+	res = h.call(t, h.DeleteLead, user, http.MethodDelete, "", "id", id, "leadId", lead.ID)
+	if res.Status != http.StatusOK {
+		t.Fatalf("DeleteLead = %d %s", res.Status, res.Message)
+	}
+	if n := count(id); n != 3 {
+		t.Fatalf("lead count after DeleteLead = %d, want 3", n)
+	}
+
+	loser := h.seed(t, "c2", "agent", "sales")
+	h.seedLead(t, loser, "l2", "b1", "img1")
+	res = h.call(t, h.Merge, user, http.MethodPost, `{"sources": ["c2"]}`, "id", id)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Merge = %d %s", res.Status, res.Message)
+	}
+	if n := count(id); n != 4 {
+		t.Errorf("survivor lead count = %d, want 4", n)
+	}
+	if n := count("c2"); n != 0 {
+		t.Errorf("merged lead count = %d, want 0", n)
+	}
+}
+
+func TestReindexCountsLeads(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	h.seedLead(t, cus, "l1", "b1")
+	h.seedLead(t, cus, "l2", "b2")
+
+	if _, err := h.reindexKeywords(); err != nil {
+		t.Fatal(err)
+	}
+	if cus, _ := h.customers.GetByID("c1"); cus.LeadCount != 2 {
+		t.Errorf("lead count = %d, want 2", cus.LeadCount)
+	}
+}
+
+func TestSearchRanksKeywords(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.Search, user, http.MethodPost, `{"filter": {"op": "and", "filters": [
+		{"op": "keyword", "value": "Khách"}, {"op": "term", "field": "dept_id", "value": "sales"}]}}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Search = %d %s", res.Status, res.Message)
+	}
+	if h.customers.lastSort != "-_score,-lead_at,id" {
+		t.Errorf("Search sorted by %q, want relevance first", h.customers.lastSort)
+	}
+}
+
+func TestMergeRepeatedSources(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+	loser := h.seed(t, "c2", "agent", "sales")
+	h.seedLead(t, loser, "l2", "b1", "img1")
+
+	res := h.call(t, h.Merge, user, http.MethodPost, `{"sources": ["c2", "c1", "c2"]}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Merge = %d %s", res.Status, res.Message)
+	}
+	if moved, _ := h.customers.GetLead("l2"); moved.CID != "c1" {
+		t.Errorf("lead belongs to %s, want c1", moved.CID)
+	}
+}
+
+func TestRestoreMergedCustomer(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+	h.seed(t, "c2", "agent", "sales")
+
+	res := h.call(t, h.Merge, agent("agent", "sales"), http.MethodPost, `{"sources": ["c2"]}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Merge = %d %s", res.Status, res.Message)
+	}
+
+	res = h.call(t, h.Restore, agent("root", "hq", "admin.member.view"), http.MethodPost, "", "id", "c2")
+	if res.Status != http.StatusConflict {
+		t.Errorf("Restore of a merged customer = %d, want %d", res.Status, http.StatusConflict)
+	}
+	if cus, _ := h.customers.GetByID("c2"); cus.DeletedAt == nil {
+		t.Error("merged customer restored")
+	}
+}
+
+func TestTransferRefusesPendingAlbums(t *testing.T) {
+	h := newTestHandler(t)
+	cus := h.seed(t, "c1", "agent", "sales")
+	cus.AlbumStatus = AlbumStatusPending
+	if err := h.saveCustomer(cus); err != nil {
+		t.Fatal(err)
+	}
+
+	res := h.call(t, h.Transfer, agent("boss", "sales", "member.view"), http.MethodPost, `{"ids": ["c1"], "to_user": "agent2"}`)
+	if res.Status != http.StatusConflict {
+		t.Fatalf("Transfer = %d, want %d", res.Status, http.StatusConflict)
+	}
+	if album := h.photos.Album(cus.Album); album.Owner != "key-agent" {
+		t.Errorf("album owned by %s, want key-agent", album.Owner)
+	}
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	AuditCustomerReveal = "customer.reveal"
+
+	// sealedPrefix marks an encrypted identity field. Values without it are
+	// plain text written before encryption was introduced.
+	sealedPrefix = "enc:v1:"
+)
+
+// hashIdentity returns the keyed hash of a normalised phone or CMND, stored
+// next to the encrypted value so customers can still be found by equality.
+func (f *fieldCipher) hashIdentity(kind, value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, f.hashKey)
+	mac.Write([]byte(kind + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fieldCipher) seal(plain string) (string, error) {
+	if len(plain) == 0 {
+		return "", nil
+	}
+	encrypted, err := f.Encrypt(plain)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + encrypted, nil
+}
+
+func (f *fieldCipher) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	return f.Decrypt(strings.TrimPrefix(value, sealedPrefix))
+}
+
+// setIdentity stores a plain phone number and CMND on a customer, encrypted.
+func (s *CustomerHandlerImpl) setIdentity(cus *entity.Customer, phone, cmnd string) error {
+	sealedPhone, err := s.cipher.seal(phone)
+	if err != nil {
+		return err
+	}
+	sealedCMND, err := s.cipher.seal(cmnd)
+	if err != nil {
+		return err
+	}
+
+	cus.Phone = sealedPhone
+	cus.PhoneHash = s.cipher.hashIdentity("phone", normalizePhone(phone))
+	cus.LastCMND = sealedCMND
+	cus.CMNDHash = s.cipher.hashIdentity("cmnd", normalizeCMND(cmnd))
+	return nil
+}
+
+// identitySealed reports whether the phone number and CMND of a customer are
+// stored encrypted.
+func identitySealed(cus *entity.Customer) bool {
+	return (len(cus.Phone) == 0 || strings.HasPrefix(cus.Phone, sealedPrefix)) &&
+		(len(cus.LastCMND) == 0 || strings.HasPrefix(cus.LastCMND, sealedPrefix))
+}
+
+// identity returns the plain phone number and CMND of a stored customer.
+func (s *CustomerHandlerImpl) identity(cus *entity.Customer) (string, string) {
+	phone, err := s.cipher.open(cus.Phone)
+	if err != nil {
+		phone = ""
+	}
+	cmnd, err := s.cipher.open(cus.LastCMND)
+	if err != nil {
+		cmnd = ""
+	}
+	return phone, cmnd
+}
+
+// maskIdentity replaces the stored phone number and CMND of a customer about
+// to be returned by their masked plain text.
+func (s *CustomerHandlerImpl) maskIdentity(cus *entity.Customer) {
+	phone, cmnd := s.identity(cus)
+	cus.Phone = maskValue(phone)
+	cus.LastCMND = maskValue(cmnd)
+	cus.PhoneHash = ""
+	cus.CMNDHash = ""
+	cus.PhonePrefixes = nil
+}
+
+// keptIdentity returns the value to store for a phone number or CMND sent by
+// a client: the current one when the client left it out or sent it back
+// masked, what was sent otherwise.
+func keptIdentity(sent, current string) string {
+	if len(sent) == 0 || strings.Contains(sent, "*") {
+		return current
+	}
+	return sent
+}
+
+// maskValue keeps the first and last two characters of a value, 0901234589
+// becomes 09******89. Values too short to keep anything are fully masked.
+func maskValue(value string) string {
+	runes := []rune(value)
+	if len(runes) == 0 {
+		return ""
+	}
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:2]) + strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-2:])
+}
+
+// Reveal returns the plain phone number and CMND of a customer to holders of
+// PermCustomerReveal who may see the customer. Every call is logged in the
+// customer history.
+func (s *CustomerHandlerImpl) Reveal(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermCustomerReveal) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	id := c.Param("id")
+	candidate, err := s.repo.GetByID(id)
+	if err != nil || candidate.DeletedAt != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+
+	if !policyFor(userInfo).CanView(candidate) {
+		return forbiddenCustomer(c)
+	}
+
+	s.audit(userInfo, AuditCustomerReveal, candidate.ID, candidate.ID, nil, nil)
+
+	phone, cmnd := s.identity(candidate)
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data: map[string]interface{}{
+			"phone":     phone,
+			"last_cmnd": cmnd,
+		},
+	})
+}
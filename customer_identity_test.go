@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"0901234589", "09******89"},
+		{"012345678901", "01********01"},
+		{"12345", "12*45"},
+		{"1234", "****"},
+		{"ab", "**"},
+		{"", ""},
+		{"Đặng Hà", "Đặ***Hà"},
+	}
+	for _, tt := range tests {
+		if got := maskValue(tt.value); got != tt.want {
+			t.Errorf("maskValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestKeptIdentity(t *testing.T) {
+	tests := []struct {
+		sent, current, want string
+	}{
+		{"", "0901234589", "0901234589"},
+		{"09******89", "0901234589", "0901234589"},
+		{"09******12", "0901234589", "0901234589"},
+		{"0987654321", "0901234589", "0987654321"},
+		{"0987654321", "", "0987654321"},
+	}
+	for _, tt := range tests {
+		if got := keptIdentity(tt.sent, tt.current); got != tt.want {
+			t.Errorf("keptIdentity(%q, %q) = %q, want %q", tt.sent, tt.current, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateKeepsMaskedIdentity(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+
+	res := h.call(t, h.Add, user, http.MethodPost, `{"full_name": "Nguyễn Văn An",
+		"phone": "0901234589", "last_cmnd": "079123456789"}`)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Add = %d %s", res.Status, res.Message)
+	}
+	id := h.waitAlbums(t, h.onlyCustomer(t).ID).ID
+	stored, _ := h.customers.GetByID(id)
+
+	// The client edits what Info returned, masked identity included.
+	res = h.call(t, h.Info, user, http.MethodGet, "", "id", id)
+	var shown entity.Customer
+	if err := json.Unmarshal(res.Data, &shown); err != nil {
+		t.Fatal(err)
+	}
+	if shown.Phone != "09******89" || shown.LastCMND != "07********89" {
+		t.Fatalf("Info shows %q %q, want them masked", shown.Phone, shown.LastCMND)
+	}
+
+	body := fmt.Sprintf(`{"full_name": "Nguyễn Văn An", "phone": %q, "last_cmnd": %q, "city": "HCM"}`,
+		shown.Phone, shown.LastCMND)
+	res = h.call(t, h.Update, user, http.MethodPut, body, "id", id)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Update = %d %s", res.Status, res.Message)
+	}
+
+	updated, _ := h.customers.GetByID(id)
+	phone, cmnd := h.identity(updated)
+	if phone != "0901234589" || cmnd != "079123456789" {
+		t.Errorf("identity = %q %q after a masked round trip", phone, cmnd)
+	}
+	if updated.Phone != stored.Phone || updated.PhoneHash != stored.PhoneHash || updated.CMNDHash != stored.CMNDHash {
+		t.Error("unchanged identity sealed again")
+	}
+	if updated.City != "HCM" {
+		t.Errorf("city = %q, want the edit saved", updated.City)
+	}
+
+	res = h.call(t, h.Update, user, http.MethodPut, `{"full_name": "Nguyễn Văn An", "phone": "0987 654 321"}`, "id", id)
+	if res.Status != http.StatusOK {
+		t.Fatalf("Update = %d %s", res.Status, res.Message)
+	}
+	updated, _ = h.customers.GetByID(id)
+	phone, cmnd = h.identity(updated)
+	if phone != "0987 654 321" || cmnd != "079123456789" {
+		t.Errorf("identity = %q %q, want the new phone and the CMND kept", phone, cmnd)
+	}
+	if updated.PhoneHash != h.cipher.hashIdentity("phone", "0987654321") {
+		t.Error("phone hash not updated")
+	}
+}
+
+func TestReindexSealsLegacyIdentity(t *testing.T) {
+	h := newTestHandler(t)
+	legacy := h.seed(t, "c1", "agent", "sales")
+	legacy.Phone = "0901234589"
+	legacy.LastCMND = "079123456789"
+	if err := h.saveCustomer(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if indexed, err := h.reindexKeywords(); err != nil || indexed != 1 {
+		t.Fatalf("reindexKeywords = %d, %v, want 1 customer", indexed, err)
+	}
+
+	stored, _ := h.customers.GetByID("c1")
+	if !identitySealed(stored) {
+		t.Fatalf("identity still in plain text: %q %q", stored.Phone, stored.LastCMND)
+	}
+	if phone, cmnd := h.identity(stored); phone != "0901234589" || cmnd != "079123456789" {
+		t.Errorf("identity = %q %q, want the legacy values", phone, cmnd)
+	}
+	if stored.PhoneHash != h.cipher.hashIdentity("phone", "0901234589") || stored.CMNDHash != h.cipher.hashIdentity("cmnd", "079123456789") {
+		t.Error("identity hashes not set")
+	}
+}
@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	// minPhonePrefix is the shortest run of digits searched as a phone prefix.
+	minPhonePrefix = 3
+
+	// minCMND is the shortest keyword looked up as a CMND.
+	minCMND = 9
+)
+
+// vietnameseFolds maps each accented lower case letter to its base letter.
+var vietnameseFolds = func() *strings.Replacer {
+	groups := map[string]string{
+		"a": "àáạảãâầấậẩẫăằắặẳẵ",
+		"e": "èéẹẻẽêềếệểễ",
+		"i": "ìíịỉĩ",
+		"o": "òóọỏõôồốộổỗơờớợởỡ",
+		"u": "ùúụủũưừứựửữ",
+		"y": "ỳýỵỷỹ",
+		"d": "đ",
+	}
+	pairs := make([]string, 0)
+	for base, accented := range groups {
+		for _, r := range accented {
+			pairs = append(pairs, string(r), base)
+		}
+	}
+	return strings.NewReplacer(pairs...)
+}()
+
+// foldText lowercases text, strips Vietnamese diacritics and keeps words
+// separated by single spaces, so "Nguyễn  Văn A," becomes "nguyen van a".
+func foldText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			// Combining marks of decomposed input.
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, text)
+	text = vietnameseFolds.Replace(text)
+
+	return strings.Join(strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// phonePrefixes returns every prefix of a normalised phone number that can be
+// searched for.
+func phonePrefixes(phone string) []string {
+	prefixes := make([]string, 0)
+	for n := minPhonePrefix; n <= len(phone); n++ {
+		prefixes = append(prefixes, phone[:n])
+	}
+	return prefixes
+}
+
+// indexKeywords fills the fields keyword search runs on. Names, addresses
+// and notes are stored folded. Phone numbers are encrypted, so only keyed
+// hashes of their prefixes are indexed.
+func (s *CustomerHandlerImpl) indexKeywords(cus *entity.Customer) {
+	cus.SearchName = foldText(cus.FullName)
+	cus.SearchText = foldText(cus.Address + " " + cus.Note)
+
+	phone, _ := s.identity(cus)
+	prefixes := phonePrefixes(normalizePhone(phone))
+	cus.PhonePrefixes = make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		cus.PhonePrefixes = append(cus.PhonePrefixes, s.cipher.hashIdentity("phone_prefix", prefix))
+	}
+}
+
+// keywordFilter matches a keyword against the folded name, address and note,
+// the phone number prefix and the CMND. It scores its matches, name matches
+// and exact identities first.
+type keywordFilter struct {
+	text      string
+	phoneHash string
+	cmndHash  string
+}
+
+func (f *keywordFilter) scores() bool {
+	return true
+}
+
+func (f *keywordFilter) Source() (interface{}, error) {
+	should := make([]interface{}, 0, 3)
+	if len(f.text) > 0 {
+		should = append(should, map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":    f.text,
+				"type":     "bool_prefix",
+				"operator": "and",
+				"fields":   []string{"search_name^3", "search_text"},
+			},
+		})
+	}
+	if len(f.phoneHash) > 0 {
+		should = append(should, map[string]interface{}{
+			"term": map[string]interface{}{
+				"phone_prefixes": map[string]interface{}{"value": f.phoneHash, "boost": 5},
+			},
+		})
+	}
+	if len(f.cmndHash) > 0 {
+		should = append(should, map[string]interface{}{
+			"term": map[string]interface{}{
+				"cmnd_hash": map[string]interface{}{"value": f.cmndHash, "boost": 5},
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}, nil
+}
+
+// keywordSearch builds the search for a keyword typed by a user; it returns
+// nil when there is nothing to search for.
+func (s *CustomerHandlerImpl) keywordSearch(keyword string) Filter {
+	f := &keywordFilter{text: foldText(keyword)}
+
+	if digits := normalizePhone(keyword); len(digits) >= minPhonePrefix && strings.IndexFunc(keyword, unicode.IsLetter) < 0 {
+		f.phoneHash = s.cipher.hashIdentity("phone_prefix", digits)
+	}
+	if cmnd := normalizeCMND(keyword); len(cmnd) >= minCMND && !strings.Contains(keyword, " ") {
+		f.cmndHash = s.cipher.hashIdentity("cmnd", cmnd)
+	}
+
+	if len(f.text) == 0 && len(f.phoneHash) == 0 && len(f.cmndHash) == 0 {
+		return nil
+	}
+	return f
+}
+
+// ReindexKeywords rebuilds the keyword search fields and lead count of every
+// customer, for records saved before they existed, and encrypts the phone
+// numbers and CMND still stored in plain text. It runs in the
+// background, progress goes to the log.
+func (s *CustomerHandlerImpl) ReindexKeywords(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	go func() {
+		indexed, err := s.reindexKeywords()
+		log.Println("reindex keywords:", indexed, "customers", err)
+	}()
+
+	return c.JSON(http.StatusAccepted, Response{
+		Code:    http.StatusAccepted,
+		Message: "Success",
+	})
+}
+
+func (s *CustomerHandlerImpl) reindexKeywords() (int, error) {
+	indexed := 0
+	err := s.eachCustomer(And(), func(cus *entity.Customer) error {
+		leads, err := s.allLeads(cus.ID)
+		if err != nil {
+			log.Println("reindex keywords", cus.ID, err)
+			return nil
+		}
+		// saveCustomer indexes the keywords. Records saved in plain text get
+		// their phone number and CMND encrypted.
+		var sealErr error
+		err = s.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.LeadCount = len(leads)
+			if !identitySealed(cus) {
+				phone, cmnd := s.identity(cus)
+				sealErr = s.setIdentity(cus, phone, cmnd)
+			}
+		})
+		if err == nil {
+			err = sealErr
+		}
+		if err != nil {
+			log.Println("reindex keywords", cus.ID, err)
+			return nil
+		}
+		indexed++
+		return nil
+	})
+	return indexed, err
+}
@@ -0,0 +1,22 @@
+package handler
+
+import "testing"
+
+func TestFoldText(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Nguyễn  Văn A,", "nguyen van a"},
+		{"ĐẶNG THỊ HỒNG", "dang thi hong"},
+		{"Quận 1 - Hồ Chí Minh", "quan 1 ho chi minh"},
+		// Decomposed input, as sent by some keyboards.
+		{"Nguye\u0302\u0303n", "nguyen"},
+		{"  ", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := foldText(tt.text); got != tt.want {
+			t.Errorf("foldText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+type MergeCustomerParam struct {
+	Sources []string `json:"sources" validate:"required,min=1"`
+}
+
+// Merge folds the customers listed in the body into the customer of the url:
+// their leads move to the survivor and the merged records are soft deleted.
+func (s *CustomerHandlerImpl) Merge(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	policy := policyFor(userInfo)
+
+	var param MergeCustomerParam
+	if err := s.bind(c, &param); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+
+	id := c.Param("id")
+	survivor, err := s.repo.GetByID(id)
+	if err != nil || survivor.DeletedAt != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+	if !policy.CanEdit(survivor) {
+		return forbiddenCustomer(c)
+	}
+
+	if survivor.AlbumStatus == AlbumStatusPending {
+		return conflictResponse(c, errAlbumPending)
+	}
+
+	losers := make([]*entity.Customer, 0, len(param.Sources))
+	seen := map[string]bool{survivor.ID: true}
+	for _, sourceId := range param.Sources {
+		if seen[sourceId] {
+			continue
+		}
+		seen[sourceId] = true
+		loser, err := s.repo.GetByID(sourceId)
+		if err != nil || loser.DeletedAt != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Không tìm thấy người dùng với ID: " + sourceId,
+			})
+		}
+		if !policy.CanEdit(loser) {
+			return c.JSON(http.StatusForbidden, Response{
+				Code:    http.StatusForbidden,
+				Message: "permission denied: you are not the owner of customer " + sourceId,
+			})
+		}
+		if loser.AlbumStatus == AlbumStatusPending {
+			return conflictResponse(c, errAlbumPending)
+		}
+		losers = append(losers, loser)
+	}
+
+	if len(losers) == 0 {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+		})
+	}
+
+	// The survivor's owner keeps every album, the lead albums of customers
+	// owned by someone else are handed over before their photos move.
+	apiKey, err := s.apiRepo.GetBy("user_id", survivor.UserID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "get api key error",
+		})
+	}
+
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	// Each step is undone if a later one fails, so a failed merge leaves
+	// both customers as they were. Audit entries and the removal of the
+	// emptied albums wait until everything succeeded.
+	tx := newSaga("merge into " + survivor.ID)
+	defer tx.rollback()
+
+	audits := make([]func(), 0)
+	emptied := make([]string, 0)
+
+	survivorBefore := snapshot(survivor)
+	for _, loser := range losers {
+		loser := loser
+		leads, err := s.allLeads(loser.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid params",
+				Data:    err.Error(),
+			})
+		}
+
+		if err := s.handOverAlbums(tx, loser.UserID, leadAlbums(leads), apiKey.ID); err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusUnprocessableEntity,
+				Message: "lỗi chuyển album: " + err.Error(),
+			})
+		}
+
+		originals := make([]*entity.CustomerLead, len(leads))
+		for i, lead := range leads {
+			originals[i] = copyLead(lead)
+			oldAlbum, err := s.moveLeadAlbum(tx, apiKey.ID, lead, survivor.Album)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, Response{
+					Code:    http.StatusUnprocessableEntity,
+					Message: "lỗi chuyển album: " + err.Error(),
+				})
+			}
+			if len(oldAlbum) > 0 {
+				emptied = append(emptied, oldAlbum)
+			}
+			lead.CID = survivor.ID
+			lead.UpdatedAt = currentTime
+		}
+
+		if len(leads) > 0 {
+			err = s.repo.AddLead(leads)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, Response{
+					Code:    http.StatusBadRequest,
+					Message: "Add lead error",
+					Data:    err.Error(),
+				})
+			}
+			tx.onRollback("leads", func() error {
+				return s.repo.AddLead(originals)
+			})
+		}
+
+		for i, lead := range leads {
+			before, lead := snapshot(originals[i]), lead
+			audits = append(audits, func() {
+				s.audit(userInfo, AuditLeadUpdate, survivor.ID, lead.ID, before, lead)
+			})
+		}
+
+		mergeCustomerInto(survivor, loser)
+		survivor.LeadCount += len(leads)
+
+		loserBefore := snapshot(loser)
+		leadCount := loser.LeadCount
+		loser.LeadCount = 0
+		loser.DeletedAt = &currentTime
+		loser.DeletedBy = userInfo.ID
+		loser.MergedInto = survivor.ID
+		loser.UpdatedAt = currentTime
+		err = s.saveCustomer(loser)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Lỗi cập nhật thông tin ID: " + loser.ID,
+			})
+		}
+		tx.onRollback("customer "+loser.ID, func() error {
+			loser.DeletedAt = nil
+			loser.DeletedBy = ""
+			loser.MergedInto = ""
+			loser.LeadCount = leadCount
+			return s.saveCustomer(loser)
+		})
+
+		audits = append(audits, func() {
+			s.audit(userInfo, AuditCustomerMerge, loser.ID, loser.ID, loserBefore, loser)
+		})
+	}
+
+	survivor.UpdatedAt = currentTime
+	err = s.saveCustomer(survivor)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Lỗi cập nhật thông tin ID: " + survivor.ID,
+		})
+	}
+	tx.commit()
+
+	for _, audit := range audits {
+		audit()
+	}
+	s.audit(userInfo, AuditCustomerMerge, survivor.ID, survivor.ID, survivorBefore, survivor)
+
+	for _, albumId := range emptied {
+		if err := s.albums.DeleteAlbum(apiKey.ID, albumId); err != nil {
+			log.Println("merge", survivor.ID, "delete album", albumId, err)
+		}
+	}
+
+	hideAlbumPasswords(survivor)
+	s.maskIdentity(survivor)
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data:    survivor,
+	})
+}
+
+// mergeCustomerInto copies what the loser knows about the customer onto the
+// survivor, without overwriting anything the survivor already has.
+func mergeCustomerInto(survivor, loser *entity.Customer) {
+	for _, d := range loser.Districts {
+		if !cutils.Contains(survivor.Districts, d) {
+			survivor.Districts = append(survivor.Districts, d)
+		}
+	}
+
+	note := strings.TrimSpace(loser.Note)
+	if len(note) > 0 && !strings.Contains(survivor.Note, note) {
+		if len(survivor.Note) > 0 {
+			survivor.Note += "\n"
+		}
+		survivor.Note += note
+	}
+
+	if loser.CreatedAt.Before(survivor.CreatedAt) {
+		survivor.CreatedAt = loser.CreatedAt
+	}
+	if loser.LeadAt != nil && (survivor.LeadAt == nil || survivor.LeadAt.Before(*loser.LeadAt)) {
+		survivor.LeadAt = loser.LeadAt
+	}
+}
+
+// moveLeadAlbum recreates the album of a lead under parentAlbum and moves its
+// photos there, registering on tx how to undo it. It returns the emptied
+// album, which the caller removes once nothing can be rolled back.
+func (s *CustomerHandlerImpl) moveLeadAlbum(tx *saga, apiKey string, lead *entity.CustomerLead, parentAlbum string) (string, error) {
+	oldAlbum := leadAlbumOf(lead)
+	if len(oldAlbum) == 0 {
+		return "", nil
+	}
+
+	var title string
+	if bikip, err := s.bikipRepo.Get(lead.BikipID); err == nil {
+		title = bikip.Title
+	}
+
+	albumId, albumPassword, err := s.createAlbum(apiKey, s.albumName.lead(title, lead.RegAt), title, parentAlbum)
+	if err != nil {
+		return "", err
+	}
+	tx.onRollback("lead album", func() error {
+		return s.albums.DeleteAlbum(apiKey, albumId)
+	})
+	lead.AlbumPassword = albumPassword
+
+	var imgIds = make([]string, 0)
+	for _, img := range lead.Images {
+		imgIds = append(imgIds, img.GalleryID)
+		img.Album = albumId
+	}
+
+	if len(imgIds) > 0 {
+		err = s.albums.MoveImages(apiKey, imgIds, albumId)
+		if err != nil {
+			return "", err
+		}
+		tx.onRollback("lead photos", func() error {
+			return s.albums.MoveImages(apiKey, imgIds, oldAlbum)
+		})
+	}
+	return oldAlbum, nil
+}
+
+// copyLead returns a copy of lead that shares no images with it.
+func copyLead(lead *entity.CustomerLead) *entity.CustomerLead {
+	dup := *lead
+	if lead.Images != nil {
+		dup.Images = make([]*entity.Image, len(lead.Images))
+		for i, img := range lead.Images {
+			image := *img
+			dup.Images[i] = &image
+		}
+	}
+	return &dup
+}
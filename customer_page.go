@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+
+	// leadSort lists the newest leads first.
+	leadSort = "-reg_at,id"
+
+	// walkSort and walkPageSize page the walks over every customer.
+	walkSort     = "-created_at,id"
+	walkPageSize = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// pageLimit applies the default and maximum page size.
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	if limit > maxPageSize {
+		return maxPageSize
+	}
+	return limit
+}
+
+// pageCursor is the position after the last item of a page: the sort values
+// the search backend returned for it, ending with the ID that breaks ties.
+// The token is opaque to clients.
+type pageCursor struct {
+	Sort  string        `json:"s"`
+	After []interface{} `json:"a"`
+}
+
+func encodeCursor(sort string, after ...interface{}) string {
+	raw, _ := json.Marshal(pageCursor{Sort: sort, After: after})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeCursor reads a token, which must have been issued for the same sort.
+func decodeCursor(token, sort string) ([]interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor pageCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, errInvalidCursor
+	}
+	if cursor.Sort != sort || len(cursor.After) == 0 {
+		return nil, errInvalidCursor
+	}
+	return cursor.After, nil
+}
+
+// listCustomers reads one page, after the cursor when there is one and from
+// the offset otherwise, and returns the token of the next page.
+func (s *CustomerHandlerImpl) listCustomers(query Filter, sort, cursor string, offset, limit int) ([]*entity.Customer, string, error) {
+	limit = pageLimit(limit)
+
+	var after []interface{}
+	if len(cursor) > 0 {
+		var err error
+		if after, err = decodeCursor(cursor, sort); err != nil {
+			return nil, "", err
+		}
+	}
+
+	customers, _, last, err := s.repo.ListPage(query, sort, after, offset, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(customers) == limit {
+		next = encodeCursor(sort, last...)
+	}
+	return customers, next, nil
+}
+
+// eachCustomer calls fn for every customer matching query, a page at a time.
+// Pages follow a cursor, not an offset: customers fn changes, even out of the
+// query, neither shift the next pages nor get visited twice. An error of fn
+// stops the walk.
+func (s *CustomerHandlerImpl) eachCustomer(query Filter, fn func(cus *entity.Customer) error) error {
+	var after []interface{}
+	for {
+		customers, _, last, err := s.repo.ListPage(query, walkSort, after, 0, walkPageSize)
+		if err != nil {
+			return err
+		}
+		for _, cus := range customers {
+			if err := fn(cus); err != nil {
+				return err
+			}
+		}
+		if len(customers) < walkPageSize {
+			return nil
+		}
+		after = last
+	}
+}
+
+func listError(c echo.Context, err error) error {
+	if errors.Is(err, errInvalidCursor) {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid cursor",
+		})
+	}
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusBadRequest,
+		Message: "Not found",
+		Data:    err.Error(),
+	})
+}
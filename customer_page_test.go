@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	token := encodeCursor("-created_at,id", "2024-05-01T10:00:00Z", "c42")
+
+	after, err := decodeCursor(token, "-created_at,id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"2024-05-01T10:00:00Z", "c42"}
+	if !reflect.DeepEqual(after, want) {
+		t.Errorf("decodeCursor = %v, want %v", after, want)
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	tests := []struct {
+		name, token string
+	}{
+		{"not base64", "!!!"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("nope"))},
+		{"other sort", encodeCursor("budget,id", 2, "c42")},
+		{"no position", encodeCursor("-created_at,id")},
+	}
+	for _, tt := range tests {
+		if _, err := decodeCursor(tt.token, "-created_at,id"); err != errInvalidCursor {
+			t.Errorf("%s: error = %v, want errInvalidCursor", tt.name, err)
+		}
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	tests := []struct {
+		limit, want int
+	}{
+		{0, defaultPageSize},
+		{-1, defaultPageSize},
+		{5, 5},
+		{maxPageSize + 1, maxPageSize},
+	}
+	for _, tt := range tests {
+		if got := pageLimit(tt.limit); got != tt.want {
+			t.Errorf("pageLimit(%d) = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestEachCustomerFollowsCursor(t *testing.T) {
+	h := newTestHandler(t)
+	const n = 2*walkPageSize + 10
+	for i := 0; i < n; i++ {
+		cus := h.seed(t, fmt.Sprintf("c%03d", i), "agent", "sales")
+		cus.AlbumStatus = AlbumStatusPending
+		if err := h.saveCustomer(cus); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Clearing the status takes each customer out of the query, paging by
+	// offset would skip every other page.
+	seen := make(map[string]int)
+	err := h.eachCustomer(Term("album_status", AlbumStatusPending), func(cus *entity.Customer) error {
+		seen[cus.ID]++
+		return h.updateCustomer(cus, func(cus *entity.Customer) {
+			cus.AlbumStatus = ""
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n {
+		t.Errorf("visited %d customers, want %d", len(seen), n)
+	}
+	for id, times := range seen {
+		if times != 1 {
+			t.Errorf("%s visited %d times", id, times)
+		}
+	}
+	if h.customers.lastSort != walkSort {
+		t.Errorf("walk sorted by %q, want %q", h.customers.lastSort, walkSort)
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net/http"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+// customerPolicy decides what a user may do with customers:
+//   - admins (PermAdminMemberView) act on every customer,
+//   - managers (PermMemberView) act on the customers of their department,
+//   - everyone else acts on the customers they own.
+type customerPolicy struct {
+	userInfo *auth.Claims
+}
+
+func policyFor(userInfo *auth.Claims) customerPolicy {
+	return customerPolicy{userInfo: userInfo}
+}
+
+func (p customerPolicy) IsAdmin() bool {
+	return cutils.Contains(p.userInfo.Perms, constant.PermAdminMemberView)
+}
+
+func (p customerPolicy) IsManager() bool {
+	return p.IsAdmin() || cutils.Contains(p.userInfo.Perms, constant.PermMemberView)
+}
+
+func (p customerPolicy) CanView(cus *entity.Customer) bool {
+	switch {
+	case p.IsAdmin():
+		return true
+	case cus.UserID == p.userInfo.ID:
+		return true
+	case p.IsManager():
+		return cus.DeptID == p.userInfo.Dept
+	}
+	return false
+}
+
+// CanEdit reports whether the user may change a customer and its leads.
+func (p customerPolicy) CanEdit(cus *entity.Customer) bool {
+	return p.CanView(cus)
+}
+
+// Scope restricts a search to the customers the user may view, the same
+// ones CanView allows; nil means no restriction.
+func (p customerPolicy) Scope() Filter {
+	if p.IsAdmin() {
+		return nil
+	}
+	own := Term("user_id", p.userInfo.ID)
+	if p.IsManager() {
+		return Or(Term("dept_id", p.userInfo.Dept), own)
+	}
+	return own
+}
+
+func forbiddenCustomer(c echo.Context) error {
+	return c.JSON(http.StatusForbidden, Response{
+		Code:    http.StatusForbidden,
+		Message: "permission denied: you are not allowed to access this customer",
+	})
+}
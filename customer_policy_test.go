@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+)
+
+func TestScopeMatchesCanView(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+	h.seed(t, "c2", "agent2", "sales")
+	// agent kept c3 when moving to sales.
+	h.seed(t, "c3", "agent", "rentals")
+	h.seed(t, "c4", "other", "rentals")
+
+	tests := []struct {
+		name string
+		user *auth.Claims
+		want []string
+	}{
+		{"owner", agent("agent", "sales"), []string{"c1", "c3"}},
+		{"manager", agent("agent", "sales", "member.view"), []string{"c1", "c2", "c3"}},
+		{"other manager", agent("boss", "rentals", "member.view"), []string{"c3", "c4"}},
+		{"admin", agent("root", "hq", "admin.member.view"), []string{"c1", "c2", "c3", "c4"}},
+	}
+	for _, tt := range tests {
+		res := h.call(t, h.List, tt.user, http.MethodGet, "")
+		var data struct {
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		}
+		if err := json.Unmarshal(res.Data, &data); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := make([]string, 0, len(data.Items))
+		for _, item := range data.Items {
+			got = append(got, item.ID)
+
+			cus, _ := h.customers.GetByID(item.ID)
+			if !policyFor(tt.user).CanView(cus) {
+				t.Errorf("%s: listed %s it may not view", tt.name, item.ID)
+			}
+		}
+		sort.Strings(got)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: listed %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: listed %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestListLeadDeniedToExperts(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+
+	user := agent("agent", "sales")
+	user.Group = constant.GroupChuyenGia
+	res := h.call(t, h.ListLead, user, http.MethodGet, "", "id", "c1")
+	if res.Status != http.StatusBadRequest {
+		t.Errorf("ListLead = %d, want %d", res.Status, http.StatusBadRequest)
+	}
+}
+
+// A manager acts on the albums of the customers of the department, which are
+// on the owner's photo account.
+func TestManagerUsesOwnerAlbums(t *testing.T) {
+	h := newTestHandler(t)
+	boss := agent("boss", "sales", "member.view")
+	cus := h.seed(t, "c1", "agent", "sales")
+	lead := h.seedLead(t, cus, "l1", "b1", "img1")
+	h.seedLead(t, cus, "l2", "b1")
+	albumId := leadAlbumOf(lead)
+
+	res := h.call(t, h.UpdateLead, boss, http.MethodPut, `{"bikip_id": "b2"}`, "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UpdateLead = %d %s", res.Status, res.Message)
+	}
+	if album := h.photos.Album(albumId); album == nil || album.Desc != "Nhà phố Quận 3 giá 9 tỷ" {
+		t.Errorf("lead album = %+v, want it renamed", album)
+	}
+
+	res = h.upload(t, h.UploadLeadImages, boss, "photo.jpg", jpeg(), "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("UploadLeadImages = %d %s", res.Status, res.Message)
+	}
+	if album := h.photos.Album(albumId); album == nil || len(album.Images) != 2 {
+		t.Errorf("lead album = %+v, want the upload in it", album)
+	}
+
+	res = h.call(t, h.DeleteLead, boss, http.MethodDelete, "", "id", "c1", "leadId", "l1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("DeleteLead = %d %s", res.Status, res.Message)
+	}
+	if h.photos.Album(albumId) != nil {
+		t.Error("lead album left behind")
+	}
+}
+
+func TestMergeCustomersOfTwoOwners(t *testing.T) {
+	h := newTestHandler(t)
+	boss := agent("boss", "sales", "member.view")
+	survivor := h.seed(t, "c1", "agent", "sales")
+	loser := h.seed(t, "c2", "agent2", "sales")
+	lead := h.seedLead(t, loser, "l2", "b1", "img1")
+	oldAlbum := leadAlbumOf(lead)
+
+	res := h.call(t, h.Merge, boss, http.MethodPost, `{"sources": ["c2"]}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Merge = %d %s", res.Status, res.Message)
+	}
+
+	moved, _ := h.customers.GetLead("l2")
+	album := h.photos.Album(leadAlbumOf(moved))
+	if album == nil || album.Owner != "key-agent" || album.Parent != survivor.Album || len(album.Images) != 1 {
+		t.Fatalf("lead album = %+v, want the photo with the survivor's owner", album)
+	}
+	if h.photos.Album(oldAlbum) != nil {
+		t.Error("emptied album left behind")
+	}
+}
+
+func TestMergeOfTwoOwnersRollsBack(t *testing.T) {
+	h := newTestHandler(t)
+	boss := agent("boss", "sales", "member.view")
+	h.seed(t, "c1", "agent", "sales")
+	loser := h.seed(t, "c2", "agent2", "sales")
+	lead := h.seedLead(t, loser, "l2", "b1", "img1")
+	oldAlbum := leadAlbumOf(lead)
+
+	h.customers.failAddLead = errNotFound
+	res := h.call(t, h.Merge, boss, http.MethodPost, `{"sources": ["c2"]}`, "id", "c1")
+	if res.Status == http.StatusOK {
+		t.Fatal("Merge succeeded although the leads could not be stored")
+	}
+
+	album := h.photos.Album(oldAlbum)
+	if album == nil || album.Owner != "key-agent2" || len(album.Images) != 1 {
+		t.Errorf("old lead album = %+v, want it back with its owner and photo", album)
+	}
+}
+
+// upload runs a handler method with a multipart "images" field holding one
+// file.
+func (h *testHandler) upload(t *testing.T, fn func(echo.Context) error, user *auth.Claims, filename string, data []byte, params ...string) testResponse {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("images", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/", &body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	c := h.echo.NewContext(req, rec)
+	c.Set(constant.KeyUserInfo, user)
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	if err := fn(c); err != nil {
+		t.Fatal(err)
+	}
+	res := testResponse{Status: rec.Code}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decode response %q: %v", rec.Body.String(), err)
+	}
+	return res
+}
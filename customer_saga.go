@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"log"
+)
+
+// saga keeps the compensating actions of a multi-step operation that spans
+// the photo service and the repository, so a failure halfway can undo the
+// steps already done.
+type saga struct {
+	name  string
+	steps []sagaStep
+	done  bool
+}
+
+type sagaStep struct {
+	name       string
+	compensate func() error
+}
+
+func newSaga(name string) *saga {
+	return &saga{name: name}
+}
+
+// onRollback registers how to undo a step that has just succeeded.
+func (sg *saga) onRollback(step string, compensate func() error) {
+	sg.steps = append(sg.steps, sagaStep{name: step, compensate: compensate})
+}
+
+// commit marks the operation as complete, rollback becomes a no-op.
+func (sg *saga) commit() {
+	sg.done = true
+}
+
+// rollback undoes the registered steps in reverse order unless the saga was
+// committed. Compensations that fail are logged and the rest still run.
+func (sg *saga) rollback() {
+	if sg.done {
+		return
+	}
+	sg.done = true
+
+	for i := len(sg.steps) - 1; i >= 0; i-- {
+		step := sg.steps[i]
+		if err := step.compensate(); err != nil {
+			log.Println("rollback", sg.name, step.name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+type SearchCustomerParam struct {
+	Filter *FilterNode `json:"filter"`
+	Sort   string      `json:"sort"`
+	Cursor string      `json:"cursor"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+// Search lists customers matching a JSON filter tree, within what the caller
+// is allowed to see.
+func (s *CustomerHandlerImpl) Search(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
+	var param SearchCustomerParam
+	if err := c.Bind(&param); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+
+	var filter Filter
+	if param.Filter != nil {
+		var err error
+		if filter, err = param.Filter.Filter(s.keywordSearch); err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Invalid filter",
+				Data:    err.Error(),
+			})
+		}
+	}
+
+	sortField, err := parseSort(param.Sort, relevanceSort(filter, "-lead_at"))
+	if err != nil {
+		return invalidSort(c, err)
+	}
+
+	query := And(filter, policyFor(userInfo).Scope(), notDeleted())
+	count, err := s.repo.Count(query)
+	if err != nil {
+		return c.JSON(http.StatusOK, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Not found",
+			Data:    err.Error(),
+		})
+	}
+
+	if count == 0 {
+		return c.JSON(http.StatusOK, Response{
+			Code:    http.StatusOK,
+			Message: "Success",
+			Data: map[string]interface{}{
+				"items": []entity.Customer{},
+				"total": 0,
+			},
+		})
+	}
+
+	customers, next, err := s.listCustomers(query, sortField, param.Cursor, param.Offset, param.Limit)
+	if err != nil {
+		return listError(c, err)
+	}
+
+	s.expandCustomers(customers)
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data: map[string]interface{}{
+			"items":       customers,
+			"total":       count,
+			"next_cursor": next,
+		},
+	})
+}
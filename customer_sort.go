@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const maxSortFields = 4
+
+// sortableFields maps the names clients sort by to the indexed fields.
+var sortableFields = map[string]string{
+	"lead_at":    "lead_at",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+	"deleted_at": "deleted_at",
+	"budget":     "budget",
+	"status":     "status",
+	"full_name":  "full_name",
+	"lead_count": "lead_count",
+	"relevance":  "_score",
+}
+
+// parseSort reads a sort such as "-lead_at,budget,full_name", where a leading
+// "-" sorts descending. It returns the canonical form handed to the
+// repository, which always ends with the ID so equal keys keep a stable
+// order. An empty sort falls back to def.
+func parseSort(sort, def string) (string, error) {
+	sort = strings.TrimSpace(sort)
+	switch sort {
+	case "":
+		sort = def
+	case "created":
+		// Older clients send "created" for the newest customers first.
+		sort = "-created_at"
+	}
+
+	keys := make([]string, 0, maxSortFields+1)
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(sort, ",") {
+		key = strings.TrimSpace(key)
+		desc := strings.HasPrefix(key, "-")
+		name := strings.TrimLeft(key, "+-")
+
+		field, ok := sortableFields[name]
+		if !ok {
+			return "", fmt.Errorf("cannot sort by %q", name)
+		}
+		if seen[field] {
+			return "", fmt.Errorf("%q is sorted twice", name)
+		}
+		seen[field] = true
+
+		if desc {
+			field = "-" + field
+		}
+		keys = append(keys, field)
+	}
+	if len(keys) > maxSortFields {
+		return "", fmt.Errorf("sort by at most %d fields", maxSortFields)
+	}
+
+	return strings.Join(append(keys, "id"), ","), nil
+}
+
+// relevanceSort ranks searches whose filter scores its matches, such as a
+// keyword, by relevance first unless the client picks a sort.
+func relevanceSort(filter Filter, def string) string {
+	if !filterScores(filter) {
+		return def
+	}
+	return "-relevance," + def
+}
+
+func invalidSort(c echo.Context, err error) error {
+	return c.JSON(http.StatusBadRequest, Response{
+		Code:    http.StatusBadRequest,
+		Message: "Invalid sort",
+		Data:    err.Error(),
+	})
+}
@@ -0,0 +1,33 @@
+package handler
+
+import "testing"
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		sort    string
+		want    string
+		wantErr bool
+	}{
+		{sort: "", want: "-created_at,id"},
+		{sort: "created", want: "-created_at,id"},
+		{sort: "-lead_at", want: "-lead_at,id"},
+		{sort: "budget, -status", want: "budget,-status,id"},
+		{sort: "+updated_at", want: "updated_at,id"},
+		{sort: "relevance", want: "_score,id"},
+		{sort: "full_name,-lead_count", want: "full_name,-lead_count,id"},
+		{sort: "password", wantErr: true},
+		{sort: "budget,-budget", wantErr: true},
+		{sort: "lead_at,created_at,updated_at,budget,status", wantErr: true},
+		{sort: "budget,,status", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSort(tt.sort, "-created_at")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSort(%q) error = %v, wantErr %v", tt.sort, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSort(%q) = %q, want %q", tt.sort, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	cutils "common-libraries/pkg/utils"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+// Customer pipeline statuses.
+const (
+	StatusNew = iota
+	StatusContacted
+	StatusViewing
+	StatusNegotiating
+	StatusDeposited
+	StatusClosed
+	StatusLost
+)
+
+var statusNames = map[int]string{
+	StatusNew:         "new",
+	StatusContacted:   "contacted",
+	StatusViewing:     "viewing",
+	StatusNegotiating: "negotiating",
+	StatusDeposited:   "deposited",
+	StatusClosed:      "closed",
+	StatusLost:        "lost",
+}
+
+// DefaultStatusTransitions lists, for each status, the statuses a customer
+// may move to next. A lost customer can be picked up again.
+var DefaultStatusTransitions = map[int][]int{
+	StatusNew:         {StatusContacted, StatusLost},
+	StatusContacted:   {StatusViewing, StatusNegotiating, StatusLost},
+	StatusViewing:     {StatusContacted, StatusNegotiating, StatusLost},
+	StatusNegotiating: {StatusViewing, StatusDeposited, StatusLost},
+	StatusDeposited:   {StatusClosed, StatusLost},
+	StatusClosed:      {},
+	StatusLost:        {StatusContacted},
+}
+
+type UpdateStatusParam struct {
+	Status  int    `json:"status"`
+	Reason  string `json:"reason" validate:"required"`
+	Version int64  `json:"version"`
+}
+
+func statusName(status int) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", status)
+}
+
+// knownStatus reports whether the transition table has a status, either as a
+// status to move from or as one to move to.
+func knownStatus(transitions map[int][]int, status int) bool {
+	if _, ok := transitions[status]; ok {
+		return true
+	}
+	for _, next := range transitions {
+		for _, n := range next {
+			if n == status {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkTransition reports why a customer cannot move from one status to
+// another. A customer whose stored status is not in the table, set before
+// the workflow existed, may move to any status of the table.
+func checkTransition(transitions map[int][]int, from, to int) error {
+	if !knownStatus(transitions, to) {
+		return fmt.Errorf("trạng thái không hợp lệ: %d", to)
+	}
+	if !knownStatus(transitions, from) {
+		return nil
+	}
+
+	for _, next := range transitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("không thể chuyển trạng thái từ %s sang %s", statusName(from), statusName(to))
+}
+
+type MigrateStatusParam struct {
+	// Statuses maps each status stored before the workflow to the status
+	// of the transition table it stands for.
+	Statuses map[int]int `json:"statuses" validate:"required,min=1"`
+}
+
+// MigrateStatuses rewrites the stored status of every customer through a
+// mapping, for values saved before the workflow or whose meaning changed. It
+// runs in the background, progress goes to the log.
+func (s *CustomerHandlerImpl) MigrateStatuses(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	if !cutils.Contains(userInfo.Perms, constant.PermAdminMemberView) {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	var param MigrateStatusParam
+	if err := s.bind(c, &param); err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+	for _, to := range param.Statuses {
+		if !knownStatus(s.statusTransitions, to) {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("trạng thái không hợp lệ: %d", to),
+			})
+		}
+	}
+
+	go func() {
+		migrated, err := s.migrateStatuses(userInfo, param.Statuses)
+		log.Println("migrate statuses:", migrated, "customers", err)
+	}()
+
+	return c.JSON(http.StatusAccepted, Response{
+		Code:    http.StatusAccepted,
+		Message: "Success",
+	})
+}
+
+func (s *CustomerHandlerImpl) migrateStatuses(userInfo *auth.Claims, statuses map[int]int) (int, error) {
+	migrated := 0
+	err := s.eachCustomer(And(), func(cus *entity.Customer) error {
+		to, ok := statuses[cus.Status]
+		if !ok || to == cus.Status {
+			return nil
+		}
+
+		currentTime := time.Now().Round(time.Second)
+		before := snapshot(cus)
+		cus.StatusHistory = append(cus.StatusHistory, &entity.CustomerStatusChange{
+			From:   cus.Status,
+			To:     to,
+			Reason: "status migration",
+			By:     userInfo.ID,
+			At:     currentTime,
+		})
+		cus.Status = to
+		cus.UpdatedAt = currentTime
+		if err := s.saveCustomer(cus); err != nil {
+			log.Println("migrate status", cus.ID, err)
+			return nil
+		}
+		s.audit(userInfo, AuditCustomerStatus, cus.ID, cus.ID, before, cus)
+		migrated++
+		return nil
+	})
+	return migrated, err
+}
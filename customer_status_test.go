@@ -0,0 +1,42 @@
+package handler
+
+import "testing"
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		wantErr  bool
+	}{
+		{"next step", StatusNew, StatusContacted, false},
+		{"back a step", StatusViewing, StatusContacted, false},
+		{"lost picked up", StatusLost, StatusContacted, false},
+		{"skip steps", StatusNew, StatusClosed, true},
+		{"closed is final", StatusClosed, StatusLost, true},
+		{"same status", StatusNew, StatusNew, true},
+		{"legacy status", 99, StatusDeposited, false},
+		{"unknown target", StatusNew, 99, true},
+		{"unknown both", 98, 99, true},
+	}
+	for _, tt := range tests {
+		err := checkTransition(DefaultStatusTransitions, tt.from, tt.to)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkTransition(%d, %d) = %v, wantErr %v", tt.name, tt.from, tt.to, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckTransitionConfigured(t *testing.T) {
+	transitions := map[int][]int{1: {2}, 2: {}}
+
+	if err := checkTransition(transitions, 1, 2); err != nil {
+		t.Errorf("1 -> 2: %v", err)
+	}
+	if err := checkTransition(transitions, 2, 1); err == nil {
+		t.Error("2 -> 1: want error")
+	}
+	// Contacted is a default status but not a configured one.
+	if err := checkTransition(transitions, 1, StatusContacted); err == nil {
+		t.Error("1 -> contacted: want error")
+	}
+}
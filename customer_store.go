@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"gitlab.com/daitheky/api-portal-admin/entity"
+	"gitlab.com/daitheky/api-portal-admin/repository"
+)
+
+// customerStore is what the customer handlers need from the customer
+// repository of api-portal-admin. Before these handlers only GetByID, Create,
+// Count, List, AddLead and ListLead existed, and Count and List took a map of
+// field conditions rather than a repository.Query.
+type customerStore interface {
+	GetByID(id string) (*entity.Customer, error)
+	Create(cus *entity.Customer) error
+	// UpdateIfVersion saves cus only while the stored version is expected,
+	// and fails with repository.ErrVersionConflict otherwise.
+	UpdateIfVersion(cus *entity.Customer, expected int64) error
+	Delete(id string) error
+
+	Count(query repository.Query) (int64, error)
+	List(query repository.Query, sort string, offset, limit int) ([]*entity.Customer, int64, error)
+	// ListPage lists after the sort values of a cursor when after is set,
+	// from offset otherwise, and returns the sort values of the last item.
+	ListPage(query repository.Query, sort string, after []interface{}, offset, limit int) ([]*entity.Customer, int64, []interface{}, error)
+	// Facets runs named aggregations and returns the count of every bucket.
+	Facets(query repository.Query, aggs map[string]interface{}) (map[string]map[string]int64, error)
+
+	AddLead(leads []*entity.CustomerLead) error
+	GetLead(id string) (*entity.CustomerLead, error)
+	DeleteLead(id string) error
+	ListLead(cid string, offset, limit int) ([]*entity.CustomerLead, int64, error)
+	ListLeadPage(cid string, after []interface{}, offset, limit int) ([]*entity.CustomerLead, int64, []interface{}, error)
+}
+
+// auditStore keeps the audit log of the customers, newest entries first.
+type auditStore interface {
+	Add(log *entity.AuditLog) error
+	List(customerID string, offset, limit int) ([]*entity.AuditLog, int64, error)
+}
+
+// The repositories of api-portal-admin must provide the stores.
+var (
+	_ customerStore = repository.CustomerRepository(nil)
+	_ auditStore    = repository.AuditRepository(nil)
+)
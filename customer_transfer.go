@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+type TransferCustomerParam struct {
+	IDs      []string `json:"ids"`
+	FromUser string   `json:"from_user"`
+	ToUser   string   `json:"to_user" validate:"required"`
+	ToDept   string   `json:"to_dept"`
+	Reason   string   `json:"reason"`
+}
+
+// Transfer hands customers over to another user, either the listed ids or
+// every customer owned by FromUser. Department managers may only move
+// customers inside their department, admins may move anything.
+func (s *CustomerHandlerImpl) Transfer(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+	policy := policyFor(userInfo)
+	isAdmin := policy.IsAdmin()
+	if !policy.IsManager() {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "Permission denied",
+		})
+	}
+
+	var param TransferCustomerParam
+	if err := s.bind(c, &param); err != nil || (len(param.IDs) == 0 && len(param.FromUser) == 0) {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+		})
+	}
+
+	toUser, err := s.userRepo.GetByID(param.ToUser)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + param.ToUser,
+		})
+	}
+	if len(param.ToDept) == 0 {
+		param.ToDept = toUser.DeptID
+	}
+	if param.ToDept != toUser.DeptID {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Người dùng " + toUser.ID + " không thuộc phòng ban " + param.ToDept,
+		})
+	}
+	if !isAdmin && param.ToDept != userInfo.Dept {
+		return c.JSON(http.StatusForbidden, Response{
+			Code:    http.StatusForbidden,
+			Message: "permission denied: cannot transfer to another department",
+		})
+	}
+
+	customers, err := s.transferCandidates(&param)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	}
+
+	for _, cus := range customers {
+		if !policy.CanEdit(cus) {
+			return c.JSON(http.StatusForbidden, Response{
+				Code:    http.StatusForbidden,
+				Message: "permission denied: customer " + cus.ID + " belongs to another department",
+			})
+		}
+		// A running album job creates albums with the previous owner's key.
+		if cus.AlbumStatus == AlbumStatusPending {
+			return conflictResponse(c, errAlbumPending)
+		}
+	}
+
+	toKey, err := s.apiRepo.GetBy("user_id", toUser.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "get api key error",
+		})
+	}
+
+	currentTime := time.Now()
+	currentTime = currentTime.Round(time.Second)
+
+	transferred := make([]string, 0, len(customers))
+	for _, cus := range customers {
+		if cus.UserID == toUser.ID && cus.DeptID == param.ToDept {
+			continue
+		}
+
+		leads, err := s.allLeads(cus.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Lỗi cập nhật thông tin ID: " + cus.ID,
+				Data:    transferred,
+			})
+		}
+
+		// The albums go back to the previous owner when a later step fails,
+		// so the customer is never split between two users. Leads keep the
+		// user who registered them.
+		tx := newSaga("transfer " + cus.ID)
+
+		err = s.transferAlbums(tx, cus, leads, toKey.ID)
+		if err != nil {
+			tx.rollback()
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusUnprocessableEntity,
+				Message: "lỗi chuyển album: " + err.Error(),
+				Data:    transferred,
+			})
+		}
+
+		before := snapshot(cus)
+		cus.Transfers = append(cus.Transfers, &entity.CustomerTransfer{
+			FromUser: cus.UserID,
+			FromDept: cus.DeptID,
+			ToUser:   toUser.ID,
+			ToDept:   param.ToDept,
+			Reason:   param.Reason,
+			By:       userInfo.ID,
+			At:       currentTime,
+		})
+		cus.UserID = toUser.ID
+		cus.DeptID = param.ToDept
+		cus.UpdatedAt = currentTime
+
+		err = s.saveCustomer(cus)
+		if err != nil {
+			tx.rollback()
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Lỗi cập nhật thông tin ID: " + cus.ID,
+				Data:    transferred,
+			})
+		}
+		tx.commit()
+		s.audit(userInfo, AuditCustomerTransfer, cus.ID, cus.ID, before, cus)
+		transferred = append(transferred, cus.ID)
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data:    transferred,
+	})
+}
+
+// transferAlbums hands the album of a customer and those of its leads, all
+// kept on the owner's account, over to the owner of toKey. It registers on tx
+// how to hand them back.
+func (s *CustomerHandlerImpl) transferAlbums(tx *saga, cus *entity.Customer, leads []*entity.CustomerLead, toKey string) error {
+	albums := make([]string, 0, len(leads)+1)
+	if len(cus.Album) > 0 {
+		albums = append(albums, cus.Album)
+	}
+	albums = append(albums, leadAlbums(leads)...)
+	return s.handOverAlbums(tx, cus.UserID, albums, toKey)
+}
+
+// leadAlbums returns the albums holding the photos of leads.
+func leadAlbums(leads []*entity.CustomerLead) []string {
+	albums := make([]string, 0, len(leads))
+	for _, lead := range leads {
+		if albumId := leadAlbumOf(lead); len(albumId) > 0 {
+			albums = append(albums, albumId)
+		}
+	}
+	return albums
+}
+
+// handOverAlbums moves albums from the photo account of fromUser to toKey,
+// registering on tx how to hand them back.
+func (s *CustomerHandlerImpl) handOverAlbums(tx *saga, fromUser string, albums []string, toKey string) error {
+	if len(albums) == 0 {
+		return nil
+	}
+
+	fromKey, err := s.apiRepo.GetBy("user_id", fromUser)
+	if err != nil {
+		return err
+	}
+	if fromKey.ID == toKey {
+		return nil
+	}
+
+	for _, albumId := range albums {
+		albumId := albumId
+		if err := s.albums.TransferAlbum(fromKey.ID, albumId, toKey); err != nil {
+			return err
+		}
+		tx.onRollback("album "+albumId, func() error {
+			return s.albums.TransferAlbum(toKey, albumId, fromKey.ID)
+		})
+	}
+	return nil
+}
+
+func (s *CustomerHandlerImpl) transferCandidates(param *TransferCustomerParam) ([]*entity.Customer, error) {
+	customers := make([]*entity.Customer, 0)
+	for _, id := range param.IDs {
+		cus, err := s.repo.GetByID(id)
+		if err != nil || cus.DeletedAt != nil {
+			return nil, errors.New("Không tìm thấy người dùng với ID: " + id)
+		}
+		customers = append(customers, cus)
+	}
+
+	if len(param.FromUser) == 0 {
+		return customers, nil
+	}
+
+	query := And(Term("user_id", param.FromUser), notDeleted())
+	err := s.eachCustomer(query, func(cus *entity.Customer) error {
+		customers = append(customers, cus)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return customers, nil
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+	"gitlab.com/daitheky/api-portal-admin/repository"
+)
+
+var errVersionMismatch = errors.New("khách hàng đã được cập nhật bởi người khác, vui lòng tải lại")
+
+// customerETag is the strong ETag of a customer, its version in quotes.
+func customerETag(cus *entity.Customer) string {
+	return `"` + strconv.FormatInt(cus.Version, 10) + `"`
+}
+
+// checkVersion compares the version the client last saw, from If-Match or
+// the body, with the stored one. Clients sending neither are not checked.
+func checkVersion(c echo.Context, cus *entity.Customer, bodyVersion int64) error {
+	if ifMatch := strings.TrimSpace(c.Request().Header.Get("If-Match")); len(ifMatch) > 0 {
+		if ifMatch == "*" {
+			return nil
+		}
+		for _, tag := range strings.Split(ifMatch, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == customerETag(cus) {
+				return nil
+			}
+		}
+		return errVersionMismatch
+	}
+
+	if bodyVersion > 0 && bodyVersion != cus.Version {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// saveCustomer stores a customer loaded from the repository, bumping its
+// version and refreshing its keyword index. The write is rejected when
+// someone saved it in the meantime.
+func (s *CustomerHandlerImpl) saveCustomer(cus *entity.Customer) error {
+	expected := cus.Version
+	cus.Version++
+	s.indexKeywords(cus)
+
+	err := s.repo.UpdateIfVersion(cus, expected)
+	if err != nil {
+		cus.Version = expected
+		if errors.Is(err, repository.ErrVersionConflict) {
+			return errVersionMismatch
+		}
+		return err
+	}
+	return nil
+}
+
+// maxSaveRetries bounds how often updateCustomer reloads a customer saved
+// by someone else in the meantime.
+const maxSaveRetries = 3
+
+// updateCustomer applies change to a customer and saves it. Writes made by
+// the server rather than from what a user saw, such as album provisioning or
+// a new lead, reload the customer and apply change again when someone saved
+// it in the meantime.
+func (s *CustomerHandlerImpl) updateCustomer(cus *entity.Customer, change func(cus *entity.Customer)) error {
+	for attempt := 0; ; attempt++ {
+		change(cus)
+		err := s.saveCustomer(cus)
+		if !errors.Is(err, errVersionMismatch) || attempt == maxSaveRetries {
+			return err
+		}
+
+		fresh, err := s.repo.GetByID(cus.ID)
+		if err != nil {
+			return err
+		}
+		*cus = *fresh
+	}
+}
+
+func conflictResponse(c echo.Context, err error) error {
+	return c.JSON(http.StatusConflict, Response{
+		Code:    http.StatusConflict,
+		Message: err.Error(),
+	})
+}
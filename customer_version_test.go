@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpdateChecksVersion(t *testing.T) {
+	h := newTestHandler(t)
+	user := agent("agent", "sales")
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.call(t, h.Info, user, http.MethodGet, "", "id", "c1")
+	etag := res.Header.Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("Info ETag = %q, want %q", etag, `"1"`)
+	}
+
+	ifMatch := http.Header{"If-Match": {etag}}
+	res = h.callWithHeader(t, h.Update, user, ifMatch, http.MethodPut, `{"full_name": "Khách c1", "city": "HCM"}`, "id", "c1")
+	if res.Status != http.StatusOK {
+		t.Fatalf("Update = %d %s", res.Status, res.Message)
+	}
+	if got := res.Header.Get("ETag"); got != `"2"` {
+		t.Errorf("Update ETag = %q, want %q", got, `"2"`)
+	}
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+	}{
+		{"stale If-Match", ifMatch, `{"full_name": "Khách c1", "city": "HN"}`},
+		{"stale weak If-Match", http.Header{"If-Match": {`W/"1"`}}, `{"full_name": "Khách c1", "city": "HN"}`},
+		{"stale body version", nil, `{"full_name": "Khách c1", "city": "HN", "version": 1}`},
+	}
+	for _, tt := range tests {
+		res := h.callWithHeader(t, h.Update, user, tt.header, http.MethodPut, tt.body, "id", "c1")
+		if res.Status != http.StatusConflict || res.Message != errVersionMismatch.Error() {
+			t.Errorf("%s: Update = %d %q, want %d", tt.name, res.Status, res.Message, http.StatusConflict)
+		}
+	}
+	if cus, _ := h.customers.GetByID("c1"); cus.City != "HCM" || cus.Version != 2 {
+		t.Errorf("customer = city %q version %d, want the first update only", cus.City, cus.Version)
+	}
+
+	for _, header := range []http.Header{{"If-Match": {`"3", "2"`}}, {"If-Match": {"*"}}} {
+		res = h.callWithHeader(t, h.Update, user, header, http.MethodPut, `{"full_name": "Khách c1", "city": "HN", "version": 1}`, "id", "c1")
+		if res.Status != http.StatusOK {
+			t.Errorf("If-Match %q: Update = %d %s", header.Get("If-Match"), res.Status, res.Message)
+		}
+	}
+}
+
+func TestUpdateStatusChecksVersion(t *testing.T) {
+	h := newTestHandler(t)
+	h.seed(t, "c1", "agent", "sales")
+
+	res := h.callWithHeader(t, h.UpdateStatus, agent("agent", "sales"), http.Header{"If-Match": {`"7"`}},
+		http.MethodPut, `{"status": 1}`, "id", "c1")
+	if res.Status != http.StatusConflict || res.Message != errVersionMismatch.Error() {
+		t.Errorf("UpdateStatus = %d %q, want %d", res.Status, res.Message, http.StatusConflict)
+	}
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+var errMissingSecret = errors.New("missing encryption secret")
+
+// fieldCipher encrypts single record fields with AES-GCM. Values are stored
+// as base64 of nonce followed by the sealed text.
+type fieldCipher struct {
+	aead    cipher.AEAD
+	hashKey []byte
+}
+
+func newFieldCipher(secret string) (*fieldCipher, error) {
+	if len(secret) == 0 {
+		return nil, errMissingSecret
+	}
+
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hashKey := sha256.Sum256([]byte("hash:" + secret))
+	return &fieldCipher{aead: aead, hashKey: hashKey[:]}, nil
+}
+
+func (f *fieldCipher) Encrypt(plain string) (string, error) {
+	if len(plain) == 0 {
+		return "", nil
+	}
+
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := f.aead.Seal(nonce, nonce, []byte(plain), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (f *fieldCipher) Decrypt(encoded string) (string, error) {
+	if len(encoded) == 0 {
+		return "", nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < f.aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	nonce, text := sealed[:f.aead.NonceSize()], sealed[f.aead.NonceSize():]
+	plain, err := f.aead.Open(nil, nonce, text, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
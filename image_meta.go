@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var errMalformedImage = errors.New("malformed image")
+
+// jpegMetaPrefixes start the APP1 segments holding Exif and XMP metadata,
+// where cameras and phones write the GPS position.
+var jpegMetaPrefixes = [][]byte{
+	[]byte("Exif\x00"),
+	[]byte("http://ns.adobe.com/xap/1.0/\x00"),
+	[]byte("http://ns.adobe.com/xmp/extension/\x00"),
+}
+
+// pngMetaKeywords are the keywords of the text chunks in which tools such as
+// ImageMagick and exiftool store Exif and XMP metadata.
+var pngMetaKeywords = map[string]bool{
+	"Raw profile type exif": true,
+	"Raw profile type APP1": true,
+	"Raw profile type xmp":  true,
+	"XML:com.adobe.xmp":     true,
+}
+
+// stripJPEGExif drops the Exif and XMP APP1 segments of a JPEG. An Exif
+// segment is replaced by one holding only its Orientation, without it photos
+// taken on their side would show rotated. The image data itself is left
+// untouched.
+func stripJPEGExif(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, errMalformedImage
+		}
+		marker := data[pos+1]
+
+		// Start of scan: the entropy coded data runs to the end of the file.
+		if marker == 0xDA {
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[pos+2 : pos+4]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errMalformedImage
+		}
+
+		segment := data[pos:end]
+		if marker != 0xE1 || !hasAnyPrefix(segment[4:], jpegMetaPrefixes) {
+			out.Write(segment)
+		} else if orientation := exifOrientation(segment[4:]); orientation != 0 {
+			out.Write(orientationExif(orientation))
+		}
+		pos = end
+	}
+
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+// exifOrientation returns the Orientation tag of the first IFD of an Exif
+// APP1 payload, 0 when there is none or it cannot be read.
+func exifOrientation(payload []byte) uint16 {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[ifd:]))
+	for i := int64(0); i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > int64(len(tiff)) {
+			return 0
+		}
+		// Orientation is a single SHORT from 1 to 8.
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		if order.Uint16(tiff[entry+2:]) != 3 || order.Uint32(tiff[entry+4:]) != 1 {
+			return 0
+		}
+		if orientation := order.Uint16(tiff[entry+8:]); orientation >= 1 && orientation <= 8 {
+			return orientation
+		}
+		return 0
+	}
+	return 0
+}
+
+// orientationExif builds an Exif APP1 segment holding the Orientation tag
+// alone.
+func orientationExif(orientation uint16) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // header, first IFD at 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // Orientation, SHORT, count 1
+		byte(orientation >> 8), byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	length := len(payload) + 2
+	return append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)}, payload...)
+}
+
+// stripPNGExif drops the eXIf chunks of a PNG, and the tEXt, zTXt and iTXt
+// chunks holding Exif or XMP metadata.
+func stripPNGExif(data []byte) ([]byte, error) {
+	signature := []byte("\x89PNG\r\n\x1a\n")
+	if !bytes.HasPrefix(data, signature) {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(signature)
+
+	pos := len(signature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errMalformedImage
+		}
+
+		if !isPNGMetaChunk(string(data[pos+4:pos+8]), data[pos+8:pos+8+length]) {
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+
+	out.Write(data[pos:])
+	return out.Bytes(), nil
+}
+
+func isPNGMetaChunk(kind string, chunk []byte) bool {
+	switch kind {
+	case "eXIf":
+		return true
+	case "tEXt", "zTXt", "iTXt":
+		// The chunk starts with its keyword, ended by a NUL.
+		keyword := chunk
+		if i := bytes.IndexByte(chunk, 0); i >= 0 {
+			keyword = chunk[:i]
+		}
+		return pngMetaKeywords[string(keyword)]
+	}
+	return false
+}
+
+func hasAnyPrefix(data []byte, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// jpegSegment builds a marker segment holding data.
+func jpegSegment(marker byte, data string) []byte {
+	length := len(data) + 2
+	return append([]byte{0xFF, marker, byte(length >> 8), byte(length)}, data...)
+}
+
+func jpeg(segments ...[]byte) []byte {
+	out := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, 0xFF, 0xDA, 0x00, 0x02, 0x12, 0x34, 0xFF, 0xD9)
+}
+
+func TestStripJPEGExif(t *testing.T) {
+	jfif := jpegSegment(0xE0, "JFIF\x00\x01\x02")
+	exif := jpegSegment(0xE1, "Exif\x00\x00GPS 10.77N 106.70E")
+	xmp := jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS</x:xmpmeta>")
+	extendedXMP := jpegSegment(0xE1, "http://ns.adobe.com/xmp/extension/\x00GPS")
+	quant := jpegSegment(0xDB, "\x00\x01\x02\x03")
+
+	tests := []struct {
+		name       string
+		data, want []byte
+	}{
+		{"exif removed", jpeg(jfif, exif, quant), jpeg(jfif, quant)},
+		{"xmp removed", jpeg(jfif, xmp, extendedXMP, quant), jpeg(jfif, quant)},
+		{"no exif", jpeg(jfif, quant), jpeg(jfif, quant)},
+		{"other app1 kept", jpeg(jpegSegment(0xE1, "Other\x00")), jpeg(jpegSegment(0xE1, "Other\x00"))},
+	}
+	for _, tt := range tests {
+		got, err := stripJPEGExif(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStripJPEGExifMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a jpeg", []byte("\x89PNG\r\n\x1a\n")},
+		{"segment past the end", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10, 0x00, 'E'}},
+		{"missing marker", []byte{0xFF, 0xD8, 0x00, 0xE1, 0x00, 0x02}},
+	}
+	for _, tt := range tests {
+		if _, err := stripJPEGExif(tt.data); err != errMalformedImage {
+			t.Errorf("%s: error = %v, want errMalformedImage", tt.name, err)
+		}
+	}
+}
+
+// pngChunk builds a chunk; the CRC is not checked by stripPNGExif.
+func pngChunk(kind, data string) []byte {
+	length := len(data)
+	out := []byte{byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}
+	out = append(out, kind...)
+	out = append(out, data...)
+	return append(out, 0, 0, 0, 0)
+}
+
+func png(chunks ...[]byte) []byte {
+	out := []byte("\x89PNG\r\n\x1a\n")
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func TestStripPNGExif(t *testing.T) {
+	header := pngChunk("IHDR", "\x00\x00\x00\x01\x00\x00\x00\x01\x08\x02\x00\x00\x00")
+	data := pngChunk("IDAT", "\x78\x9c")
+	end := pngChunk("IEND", "")
+	comment := pngChunk("tEXt", "Comment\x00made on a phone")
+
+	tests := []struct {
+		name       string
+		data, want []byte
+	}{
+		{"eXIf removed", png(header, pngChunk("eXIf", "MM\x00*GPS"), data, end), png(header, data, end)},
+		{"raw exif text removed", png(header, pngChunk("tEXt", "Raw profile type exif\x00\nexif\n 20\n4578"), data, end), png(header, data, end)},
+		{"raw exif zTXt removed", png(header, pngChunk("zTXt", "Raw profile type APP1\x00\x00\x78\x9c"), data, end), png(header, data, end)},
+		{"xmp iTXt removed", png(header, pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"), data, end), png(header, data, end)},
+		{"other text kept", png(header, comment, data, end), png(header, comment, data, end)},
+	}
+	for _, tt := range tests {
+		got, err := stripPNGExif(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := stripPNGExif(append(png(header), 0, 0, 1, 0, 'I', 'D', 'A', 'T', 0, 0, 0, 0)); err != errMalformedImage {
+		t.Errorf("chunk past the end: error = %v, want errMalformedImage", err)
+	}
+}
+
+// exifSegment builds an Exif APP1 segment whose first IFD holds an
+// Orientation tag and a GPS IFD pointer, in the given byte order.
+func exifSegment(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+2*12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 0x2A)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 2)
+
+	gps := tiff[10:]
+	order.PutUint16(gps, 0x8825)
+	order.PutUint16(gps[2:], 4)
+	order.PutUint32(gps[4:], 1)
+	order.PutUint32(gps[8:], 1000)
+
+	rotation := tiff[22:]
+	order.PutUint16(rotation, 0x0112)
+	order.PutUint16(rotation[2:], 3)
+	order.PutUint32(rotation[4:], 1)
+	order.PutUint16(rotation[8:], orientation)
+
+	return jpegSegment(0xE1, "Exif\x00\x00"+string(tiff)+"GPS 10.77N 106.70E")
+}
+
+func TestStripJPEGExifKeepsOrientation(t *testing.T) {
+	jfif := jpegSegment(0xE0, "JFIF\x00\x01\x02")
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		got, err := stripJPEGExif(jpeg(jfif, exifSegment(order, 6)))
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		if want := jpeg(jfif, orientationExif(6)); !bytes.Equal(got, want) {
+			t.Errorf("%v: got % x, want % x", order, got, want)
+		}
+		if bytes.Contains(got, []byte("GPS")) {
+			t.Errorf("%v: location kept", order)
+		}
+		if o := exifOrientation(orientationExif(6)[4:]); o != 6 {
+			t.Errorf("orientation of the rebuilt segment = %d, want 6", o)
+		}
+	}
+
+	// An orientation out of range is dropped with the rest.
+	got, err := stripJPEGExif(jpeg(jfif, exifSegment(binary.BigEndian, 9)))
+	if err != nil || !bytes.Equal(got, jpeg(jfif)) {
+		t.Errorf("invalid orientation: got % x, %v", got, err)
+	}
+}
@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gitlab.com/daitheky/api-portal-admin/auth"
+	"gitlab.com/daitheky/api-portal-admin/constant"
+	"gitlab.com/daitheky/api-portal-admin/entity"
+)
+
+const (
+	defaultMaxImageSize = 10 << 20
+	maxImagesPerUpload  = 20
+)
+
+var errImageType = errors.New("chỉ chấp nhận ảnh JPEG hoặc PNG")
+
+// UploadLeadImages stores the photos of a multipart "images" field in the
+// album of a lead and attaches them to the lead. Location data is removed
+// before the photos leave the server.
+func (s *CustomerHandlerImpl) UploadLeadImages(c echo.Context) error {
+	userInfo := c.Get(constant.KeyUserInfo).(*auth.Claims)
+
+	id := c.Param("id")
+	leadId := c.Param("leadId")
+	candidate, err := s.repo.GetByID(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy người dùng với ID: " + id,
+		})
+	}
+
+	if candidate.DeletedAt != nil {
+		return deletedCustomer(c, id)
+	}
+
+	if !policyFor(userInfo).CanEdit(candidate) {
+		return forbiddenCustomer(c)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["images"]) == 0 || len(form.File["images"]) > maxImagesPerUpload {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+		})
+	}
+
+	defer s.leadLocks.lock(id)()
+
+	leads, err := s.allLeads(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Invalid params",
+			Data:    err.Error(),
+		})
+	}
+
+	var lead *entity.CustomerLead
+	for _, l := range leads {
+		if l.ID == leadId {
+			lead = l
+			break
+		}
+	}
+	if lead == nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Không tìm thấy lead với ID: " + leadId,
+		})
+	}
+
+	// Read and clean every file first so a bad one rejects the whole upload
+	// before anything reaches the photo service.
+	files := form.File["images"]
+	images := make([][]byte, 0, len(files))
+	for _, file := range files {
+		data, err := s.readImage(file)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: file.Filename + ": " + err.Error(),
+			})
+		}
+		images = append(images, data)
+	}
+
+	apiKey, err := s.apiRepo.GetBy("user_id", candidate.UserID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "get api key error",
+		})
+	}
+
+	// Photos of a lead waiting for its album are uploaded without album,
+	// the album job moves them in once the album exists.
+	albumId := leadAlbumOf(lead)
+	pending := needsAlbum(lead.AlbumStatus) || len(albumId) == 0
+	if pending {
+		albumId = ""
+		lead.AlbumStatus = AlbumStatusPending
+	}
+
+	before := snapshot(lead)
+	for i, data := range images {
+		galleryId, err := s.albums.UploadImage(apiKey.ID, albumId, files[i].Filename, data)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusUnprocessableEntity,
+				Message: "lỗi upload ảnh: " + err.Error(),
+			})
+		}
+		lead.Images = append(lead.Images, &entity.Image{
+			GalleryID: galleryId,
+			Album:     albumId,
+			Category:  "7", // Category customer
+		})
+	}
+
+	lead.UpdatedAt = time.Now().Round(time.Second)
+	err = s.repo.AddLead([]*entity.CustomerLead{lead})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, Response{
+			Code:    http.StatusBadRequest,
+			Message: "Update lead error",
+			Data:    err.Error(),
+		})
+	}
+
+	s.audit(userInfo, AuditLeadUpdate, candidate.ID, lead.ID, before, lead)
+
+	// As in Lead, the customer is marked pending after the lead is stored.
+	if pending {
+		err = s.updateCustomer(candidate, func(cus *entity.Customer) {
+			cus.AlbumStatus = AlbumStatusPending
+		})
+		s.albumQueue.enqueue(candidate.ID)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, Response{
+				Code:    http.StatusBadRequest,
+				Message: "Lỗi cập nhật thông tin ID: " + id,
+			})
+		}
+	}
+
+	return c.JSON(http.StatusOK, Response{
+		Code:    http.StatusOK,
+		Message: "Success",
+		Data:    lead,
+	})
+}
+
+// readImage reads an uploaded photo, checks its size and type and strips its
+// Exif data.
+func (s *CustomerHandlerImpl) readImage(file *multipart.FileHeader) ([]byte, error) {
+	if file.Size > s.maxImageSize {
+		return nil, errors.New("ảnh vượt quá dung lượng cho phép")
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, s.maxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.maxImageSize {
+		return nil, errors.New("ảnh vượt quá dung lượng cho phép")
+	}
+
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return stripJPEGExif(data)
+	case "image/png":
+		return stripPNGExif(data)
+	}
+	return nil, errImageType
+}